@@ -0,0 +1,229 @@
+package interpreter
+
+import (
+    "errors"
+    "fmt"
+    "math"
+)
+
+// isBitwiseOperator reports whether operator only works on ints
+func isBitwiseOperator(operator string) bool {
+    switch operator {
+    case "&", "|", "xor", "<<", ">>", "~":
+        return true
+    }
+
+    return false
+}
+
+// applyArithmetic applies a binary arithmetic or bitwise operator to two
+// numbers. Operations on two ints result in an int. Whole number literals,
+// flagged by leftWhole and rightWhole, are treated like ints when combined
+// with one, all whole numbers when used with a bitwise operator. Int
+// arithmetic is checked for overflows.
+func applyArithmetic(operator string, value, rightValue interface{}, leftWhole, rightWhole bool) (interface{}, error) {
+    if !isNumber(value) {
+        return nil, fmt.Errorf("Value '%v' cannot be used with the operator '%s', it is not a number", formatElement(value), operator)
+    }
+    if !isNumber(rightValue) {
+        return nil, fmt.Errorf("Value '%v' cannot be used with the operator '%s', it is not a number", formatElement(rightValue), operator)
+    }
+
+    bitwise := isBitwiseOperator(operator)
+    _, leftInt := value.(int64)
+    _, rightInt := rightValue.(int64)
+    left, leftIsInt := asInt(value, bitwise || (leftWhole && rightInt))
+    right, rightIsInt := asInt(rightValue, bitwise || (rightWhole && leftInt))
+
+    if leftIsInt && rightIsInt {
+        return applyIntArithmetic(operator, left, right)
+    }
+
+    if bitwise {
+        return nil, fmt.Errorf("The operator '%s' can only be used on ints", operator)
+    }
+
+    a := toFloat64(value)
+    b := toFloat64(rightValue)
+
+    switch operator {
+    case "+":
+        return a + b, nil
+    case "-":
+        return a - b, nil
+    case "*":
+        return a * b, nil
+    case "/":
+        return a / b, nil
+    case "%":
+        return math.Mod(a, b), nil
+    case "^":
+        return math.Pow(a, b), nil
+    }
+
+    return nil, fmt.Errorf("Unknown operator '%s'", operator)
+}
+
+func applyIntArithmetic(operator string, a, b int64) (interface{}, error) {
+    switch operator {
+    case "+":
+        if (b > 0 && a > math.MaxInt64 - b) || (b < 0 && a < math.MinInt64 - b) {
+            return nil, errors.New("Integer overflow")
+        }
+        return a + b, nil
+    case "-":
+        if (b < 0 && a > math.MaxInt64 + b) || (b > 0 && a < math.MinInt64 + b) {
+            return nil, errors.New("Integer overflow")
+        }
+        return a - b, nil
+    case "*":
+        return multiplyInt(a, b)
+    case "/":
+        if b == 0 {
+            return nil, errors.New("Integer division by zero")
+        }
+        if a == math.MinInt64 && b == -1 {
+            return nil, errors.New("Integer overflow")
+        }
+        return a / b, nil
+    case "%":
+        if b == 0 {
+            return nil, errors.New("Integer division by zero")
+        }
+        if b == -1 {
+            return int64(0), nil
+        }
+        return a % b, nil
+    case "^":
+        if b < 0 {
+            return math.Pow(float64(a), float64(b)), nil
+        }
+
+        result := int64(1)
+        var err error
+        for i := int64(0); i < b; i++ {
+            result, err = multiplyInt(result, a)
+            if err != nil {
+                return nil, err
+            }
+            if result == 0 || result == 1 {
+                break
+            }
+        }
+        return result, nil
+    case "&":
+        return a & b, nil
+    case "|":
+        return a | b, nil
+    case "xor":
+        return a ^ b, nil
+    case "<<":
+        if b < 0 {
+            return nil, errors.New("Negative shift count")
+        }
+        if a == 0 {
+            return a, nil
+        }
+        // Shifting out bits, including the sign, is an overflow
+        if b >= 64 || (a << uint(b)) >> uint(b) != a {
+            return nil, errors.New("Integer overflow")
+        }
+        return a << uint(b), nil
+    case ">>":
+        if b < 0 {
+            return nil, errors.New("Negative shift count")
+        }
+        if b >= 64 {
+            b = 63
+        }
+        return a >> uint(b), nil
+    }
+
+    return nil, fmt.Errorf("Unknown operator '%s'", operator)
+}
+
+func multiplyInt(a, b int64) (int64, error) {
+    if a == 0 || b == 0 {
+        return 0, nil
+    }
+
+    result := a * b
+    if result / b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+        return 0, errors.New("Integer overflow")
+    }
+
+    return result, nil
+}
+
+// asInt returns value as an int64 if it is an int, or a whole number if
+// convert is set
+func asInt(value interface{}, convert bool) (int64, bool) {
+    switch number := value.(type) {
+    case int64:
+        return number, true
+    case float64:
+        if convert && number == math.Trunc(number) && number >= math.MinInt64 && number < math.MaxInt64 {
+            return int64(number), true
+        }
+    }
+
+    return 0, false
+}
+
+func isNumber(value interface{}) bool {
+    switch value.(type) {
+    case float64, int64:
+        return true
+    }
+
+    return false
+}
+
+func toFloat64(value interface{}) float64 {
+    switch number := value.(type) {
+    case float64:
+        return number
+    case int64:
+        return float64(number)
+    }
+
+    return 0
+}
+
+// compareNumbers returns a negative number if value is smaller than
+// rightValue, 0 if both are equal and a positive number otherwise
+func compareNumbers(value, rightValue interface{}) int {
+    left, leftIsInt := value.(int64)
+    right, rightIsInt := rightValue.(int64)
+
+    if leftIsInt && rightIsInt {
+        switch {
+        case left < right:
+            return -1
+        case left > right:
+            return 1
+        }
+        return 0
+    }
+
+    a := toFloat64(value)
+    b := toFloat64(rightValue)
+
+    switch {
+    case a < b:
+        return -1
+    case a > b:
+        return 1
+    }
+
+    return 0
+}
+
+// isEqual compares two values, ints and numbers are compared by their numeric value
+func isEqual(value, rightValue interface{}) bool {
+    if isNumber(value) && isNumber(rightValue) {
+        return compareNumbers(value, rightValue) == 0
+    }
+
+    return value == rightValue
+}
@@ -0,0 +1,877 @@
+package interpreter
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+)
+
+// Opcode selects what an Instruction does. Expressions are compiled to
+// instructions working on a stack of values, every instruction pops its
+// operands and pushes its result.
+type Opcode byte
+
+const (
+    // OpConst pushes the constant Arg
+    OpConst Opcode = iota
+    // OpLoad pushes the value of the variable Arg and fails if it has none.
+    // OpLoadRaw pushes the value as it is, OpLoadParameter pushes an empty
+    // string instead of nothing like parameters naming a variable do.
+    OpLoad
+    OpLoadRaw
+    OpLoadParameter
+    // OpAssign pops the value of a set statement, converts it to the type of
+    // the variable Arg and stores it
+    OpAssign
+    // OpNot, OpNegate and OpComplement apply the prefix operators ! - and ~
+    OpNot
+    OpNegate
+    OpComplement
+    // The binary operators pop their right operand, then their left one. Arg
+    // flags the operands that are whole number literals, 1 the left and 2
+    // the right one.
+    OpAdd
+    OpSubtract
+    OpMultiply
+    OpDivide
+    OpModulo
+    OpPower
+    OpBitAnd
+    OpBitOr
+    OpXor
+    OpShiftLeft
+    OpShiftRight
+    OpEqual
+    OpNotEqual
+    OpLess
+    OpGreater
+    OpLessEqual
+    OpGreaterEqual
+    // OpAnd and OpOr check the left operand of && and ||. If it decides the
+    // result it is kept and execution continues at Jump, behind the right
+    // operand, otherwise it is popped. OpLogical checks the right operand,
+    // Arg is 0 for && and 1 for ||.
+    OpAnd
+    OpOr
+    OpLogical
+    // OpBuiltin replaces the arguments on the stack by the result of the builtin call Arg
+    OpBuiltin
+    // OpIndex pops a key and a value and pushes the element of the value at the key
+    OpIndex
+    // OpField replaces a value by its field named by the constant Arg
+    OpField
+    // OpNumber converts a value to a number like Evaluate does
+    OpNumber
+    // OpTrace writes the value of the expression to StdErr, its source is the
+    // constant Arg. It is only compiled into programs that trace evaluations.
+    OpTrace
+    // OpPrint writes the constant Arg, OpWrite pops a value and writes it and
+    // OpNewline ends the line of an out statement
+    OpPrint
+    OpWrite
+    OpNewline
+    // OpList and OpMap check the target of append and delete, they fail with
+    // the message in the constant Arg. OpAppend pops a value and a list,
+    // OpDelete a key and a map.
+    OpList
+    OpAppend
+    OpMap
+    OpDelete
+    // OpPathIndex and OpPathField follow a step of the target of a set
+    // statement. The last step is checked by OpIndexSetter or OpFieldSetter
+    // before the value is evaluated and assigned by OpSetIndex or OpSetField.
+    OpPathIndex
+    OpPathField
+    OpIndexSetter
+    OpFieldSetter
+    OpSetIndex
+    OpSetField
+    // OpRun executes the statement Arg, which has no instructions of its own
+    OpRun
+    // OpJump continues at Jump
+    OpJump
+    // OpBranch pops a condition and continues at Jump if it is false
+    OpBranch
+    // OpFor pops the start, limit and step of the loop Arg, OpForEach its
+    // collection. They continue at Jump if there is nothing to do.
+    OpFor
+    OpForEach
+    // OpForNext and OpForEachNext advance the loop Arg and continue at Jump,
+    // the start of its body, unless the loop is done
+    OpForNext
+    OpForEachNext
+    // OpCall pops the arguments of the call Arg, pushes a frame and continues
+    // at Jump, the start of the function
+    OpCall
+    // OpResult converts the value of a return statement to the result type of the function
+    OpResult
+    // OpReturn pops the result of a function and leaves it
+    OpReturn
+    // OpEnd leaves a function at its end, returning its result variable Arg
+    // if it has one
+    OpEnd
+)
+
+var opcodeNames = [...]string{
+    "const", "load", "loadraw", "loadparam", "assign",
+    "not", "negate", "complement",
+    "add", "sub", "mul", "div", "mod", "pow", "bitand", "bitor", "xor", "shl", "shr",
+    "eq", "ne", "lt", "gt", "le", "ge",
+    "and", "or", "logical", "builtin", "index", "field", "number", "trace",
+    "print", "write", "newline", "list", "append", "map", "delete",
+    "pathindex", "pathfield", "indexsetter", "fieldsetter", "setindex", "setfield",
+    "run", "jump", "branch", "for", "foreach", "fornext", "foreachnext", "call", "result", "return", "end",
+}
+
+func (op Opcode) String() string {
+    return opcodeNames[op]
+}
+
+// binaryOperators holds the operators of the binary opcodes, starting with OpAdd
+var binaryOperators = [...]string{"+", "-", "*", "/", "%", "^", "&", "|", "xor", "<<", ">>", "==", "!=", "<", ">", "<=", ">="}
+
+// unaryOperators holds the operators of the prefix opcodes, starting with OpNot
+var unaryOperators = [...]string{"!", "-", "~"}
+
+// logicalOperators holds the operators checked by OpAnd, OpOr and OpLogical
+var logicalOperators = [...]string{"&&", "||"}
+
+// slot is the storage location of a variable. Global variables are indexed
+// into the globals of the machine, all others into the locals of the
+// innermost frame of function.
+type slot struct {
+    function *FunctionDeclarationNode
+    index int
+    // name is used in errors and disassemblies
+    name string
+}
+
+type Instruction struct {
+    Op Opcode
+    // Arg is the operand of the instruction, an index into the constants,
+    // variables, builtins, loops, calls or statements of the program
+    Arg int
+    // Jump is the index of the instruction jumps continue at
+    Jump int
+}
+
+// builtinCall is a call of one of the builtinFunctions with its arguments
+// on the stack
+type builtinCall struct {
+    name string
+    function builtinFunction
+    arguments int
+}
+
+// callSite holds the slots a call of a function passes values through
+type callSite struct {
+    function *FunctionDeclarationNode
+    parameters []slot
+    // target receives the result, nil if it is discarded
+    target *slot
+}
+
+// loopSlots are the variables of a for loop, its loop variable, limit and
+// step, or of a foreach loop, its loop variable, items and index
+type loopSlots [3]slot
+
+// compiledStatement is a statement run by OpRun, with the index of the scope
+// it accesses variables through
+type compiledStatement struct {
+    statement statementNode
+    scope int
+}
+
+// Program is the flat form of a parsed script, created by CompileProgram and
+// run by Execute. Jumps are resolved to instruction indices and variables
+// to slots, so nothing has to be looked up by walking scopes at runtime.
+type Program struct {
+    Code []Instruction
+    // nodes holds the statement each instruction was compiled from, errors
+    // are reported at it
+    nodes []INode
+    // starts maps node IDs to the first instruction compiled from the node
+    starts []int
+
+    constants []interface{}
+    variables []slot
+    builtins []builtinCall
+    loops []loopSlots
+    calls []callSite
+    statements []compiledStatement
+    // catches holds the variables receiving the errors caught by catch blocks
+    catches map[*CatchNode]slot
+
+    scopes []programScope
+    scopeIndex map[*Scope]int
+    // globals holds the declared values of all global variables, locals the
+    // ones of the variables of each function
+    globals []interface{}
+    locals map[*FunctionDeclarationNode][]interface{}
+
+    // traceEval is set if every expression ends with an OpTrace
+    traceEval bool
+}
+
+// String disassembles the program, one instruction per line
+func (program *Program) String() string {
+    lines := make([]string, len(program.Code))
+    for i, ins := range program.Code {
+        node := program.nodes[i]
+        lines[i] = fmt.Sprintf("%4d  %-32s; %d: %s", i, program.describe(ins), node.GetPosition().Line, node.GetKeyword())
+    }
+
+    return strings.Join(lines, "\n")
+}
+
+// describe formats an instruction together with its operand
+func (program *Program) describe(ins Instruction) string {
+    str := fmt.Sprintf("%-12s", ins.Op)
+
+    switch ins.Op {
+    case OpConst, OpField, OpTrace, OpPrint, OpList, OpMap, OpPathField, OpSetField:
+        str += formatElement(program.constants[ins.Arg])
+    case OpLoad, OpLoadRaw, OpLoadParameter, OpAssign:
+        str += program.variables[ins.Arg].name
+    case OpBuiltin:
+        str += program.builtins[ins.Arg].name
+    case OpJump, OpBranch, OpFor, OpForEach, OpForNext, OpForEachNext, OpCall, OpAnd, OpOr:
+        str += fmt.Sprintf("-> %d", ins.Jump)
+    case OpEnd:
+        if ins.Arg >= 0 {
+            str += program.variables[ins.Arg].name
+        }
+    }
+
+    return str
+}
+
+// start returns the index of the first instruction compiled from node, or
+// the end of the program for nil
+func (program *Program) start(node INode) int {
+    if node == nil {
+        return len(program.Code)
+    }
+
+    return program.starts[node.GetID()]
+}
+
+// programScope maps the variableSlots resolved by the nodes of a scope to the
+// slots of the variables
+type programScope struct {
+    scope *Scope
+    // slots holds the slots of the variables of the scope itself, followed by
+    // the ones of its base scopes
+    slots [][]slot
+}
+
+func (s programScope) slot(at variableSlot) slot {
+    return s.slots[at.depth][at.index]
+}
+
+type jumpPatch struct {
+    at int
+    target INode
+    // offset is added to the start of target, to skip the jump in front of an elseif
+    offset int
+}
+
+type bytecodeCompiler struct {
+    program *Program
+    patches []jumpPatch
+    // conditions maps else and elseif nodes to the if they belong to
+    conditions map[*ElseNode]*ConditionNode
+    // loops maps for and foreach nodes to their loop slots
+    loops map[INode]int
+    variableIndex map[slot]int
+    // node is the statement being compiled, errors of the instructions
+    // emitted are reported at it
+    node INode
+}
+
+// CompileProgram translates the nodes returned by ParseTokens into bytecode.
+// With traceEval set, the value of every expression is traced like
+// EvaluateValue does with VerboseEval.
+func CompileProgram(nodes []INode, traceEval bool) (*Program, error) {
+    c := &bytecodeCompiler{
+        program: &Program{starts: make([]int, len(nodes)), catches: make(map[*CatchNode]slot), scopeIndex: make(map[*Scope]int), locals: make(map[*FunctionDeclarationNode][]interface{}), traceEval: traceEval},
+        conditions: make(map[*ElseNode]*ConditionNode),
+        loops: make(map[INode]int),
+        variableIndex: make(map[slot]int),
+    }
+
+    c.allocate(nodes)
+
+    for i, node := range nodes {
+        c.program.starts[i] = len(c.program.Code)
+
+        c.node = node
+        err := c.compileNode(node)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    for _, patch := range c.patches {
+        c.program.Code[patch.at].Jump = c.program.start(patch.target) + patch.offset
+    }
+
+    return c.program, nil
+}
+
+// allocate assigns a slot to every variable and resolves the variables
+// visible in each scope
+func (c *bytecodeCompiler) allocate(nodes []INode) {
+    var scopes []*Scope
+    seen := make(map[*Scope]bool)
+    addScope := func(scope *Scope) {
+        for ; scope != nil && scope != DummyScope && !seen[scope]; scope = scope.baseScope {
+            seen[scope] = true
+            scopes = append(scopes, scope)
+        }
+    }
+
+    for _, node := range nodes {
+        addScope(node.GetScope())
+
+        switch n := node.(type) {
+        case *FunctionDeclarationNode:
+            addScope(n.BodyScope)
+        case *ForNode:
+            addScope(n.BodyScope)
+        case *ForEachNode:
+            addScope(n.BodyScope)
+        case *CatchNode:
+            addScope(n.BodyScope)
+        }
+    }
+
+    owned := make(map[*Scope][]slot, len(scopes))
+    for _, scope := range scopes {
+        slots := make([]slot, len(scope.variables))
+        for i, value := range scope.variables {
+            slots[i] = c.declare(scope.function, value)
+        }
+
+        owned[scope] = slots
+    }
+
+    for i, scope := range scopes {
+        var visible [][]slot
+        for s := scope; s != nil && s != DummyScope; s = s.baseScope {
+            visible = append(visible, owned[s])
+        }
+
+        c.program.scopes = append(c.program.scopes, programScope{scope: scope, slots: visible})
+        c.program.scopeIndex[scope] = i
+    }
+}
+
+func (c *bytecodeCompiler) declare(function *FunctionDeclarationNode, value interface{}) slot {
+    if function == nil {
+        c.program.globals = append(c.program.globals, value)
+        return slot{index: len(c.program.globals) - 1}
+    }
+
+    c.program.locals[function] = append(c.program.locals[function], value)
+    return slot{function: function, index: len(c.program.locals[function]) - 1}
+}
+
+func (c *bytecodeCompiler) emit(ins Instruction) int {
+    c.program.Code = append(c.program.Code, ins)
+    c.program.nodes = append(c.program.nodes, c.node)
+
+    return len(c.program.Code) - 1
+}
+
+func (c *bytecodeCompiler) emitConstant(value interface{}) {
+    c.emit(Instruction{Op: OpConst, Arg: c.constant(value)})
+}
+
+// print writes text, joining it with the text printed right before by the same statement
+func (c *bytecodeCompiler) print(text string) {
+    last := len(c.program.Code) - 1
+    if last >= 0 && c.program.Code[last].Op == OpPrint && c.program.nodes[last] == c.node {
+        at := c.program.Code[last].Arg
+        c.program.constants[at] = c.program.constants[at].(string) + text
+        return
+    }
+
+    c.emit(Instruction{Op: OpPrint, Arg: c.constant(text)})
+}
+
+func (c *bytecodeCompiler) constant(value interface{}) int {
+    c.program.constants = append(c.program.constants, value)
+    return len(c.program.constants) - 1
+}
+
+// jumpTo makes the instruction at continue at the start of target, once it is compiled
+func (c *bytecodeCompiler) jumpTo(at int, target INode, offset int) {
+    c.patches = append(c.patches, jumpPatch{at: at, target: target, offset: offset})
+}
+
+// branchTo jumps to the code entered when the previous condition failed,
+// which is the condition of an elseif or the body of an else
+func (c *bytecodeCompiler) branchTo(at int, branch INode) {
+    if _, ok := branch.(*ElseNode); ok {
+        c.jumpTo(at, branch, 1)
+        return
+    }
+
+    c.jumpTo(at, branch, 0)
+}
+
+// slotOf resolves a variable visible in scope
+func (c *bytecodeCompiler) slotOf(scope *Scope, name string) slot {
+    at, _ := scope.resolveSlot(name)
+    s := c.program.scopes[c.program.scopeIndex[scope]].slot(at)
+    s.name = name
+
+    return s
+}
+
+// variable returns the index of the variable resolved to at in scope
+func (c *bytecodeCompiler) variable(scope *Scope, at variableSlot, name string) int {
+    s := c.program.scopes[c.program.scopeIndex[scope]].slot(at)
+    s.name = name
+
+    if index, ok := c.variableIndex[s]; ok {
+        return index
+    }
+
+    c.program.variables = append(c.program.variables, s)
+    c.variableIndex[s] = len(c.program.variables) - 1
+
+    return len(c.program.variables) - 1
+}
+
+func (c *bytecodeCompiler) variableOf(scope *Scope, name string) int {
+    at, _ := scope.resolveSlot(name)
+    return c.variable(scope, at, name)
+}
+
+// loop allocates the loop slots of a for or foreach node
+func (c *bytecodeCompiler) loop(node INode, body *Scope, names ...string) int {
+    var slots loopSlots
+    for i, name := range names {
+        slots[i] = c.slotOf(body, name)
+    }
+
+    c.program.loops = append(c.program.loops, slots)
+    c.loops[node] = len(c.program.loops) - 1
+
+    return len(c.program.loops) - 1
+}
+
+func (c *bytecodeCompiler) compileNode(node INode) error {
+    switch n := node.(type) {
+    case *NumberDeclarationNode, *LiteralDeclarationNode, *IntDeclarationNode, *BoolDeclarationNode, *ListDeclarationNode, *MapDeclarationNode, *StructDeclarationNode:
+        // Variables are allocated up front
+    case *StructDefinitionNode, *FieldDefinitionNode, *TryNode, *ImportNode:
+        // Nothing to execute, the fields of structs don't contain any code and
+        // imported modules follow their import
+    case *FunctionDeclarationNode:
+        c.jumpTo(c.emit(Instruction{Op: OpJump}), n.nextAfterEnd, 0)
+    case *CallNode:
+        fn, ok := n.GetScope().GetFunctionNode(n.Parameter[0].GetRaw()).(*FunctionDeclarationNode)
+        if !ok {
+            return errors.New("Tried to call non-existing function")
+        }
+
+        site := callSite{function: fn}
+        for _, passer := range fn.Parameters {
+            err := c.compileParameter(n.Passers[passer.Name], n.GetScope())
+            if err != nil {
+                return err
+            }
+
+            site.parameters = append(site.parameters, c.slotOf(fn.BodyScope, passer.Name))
+        }
+        if n.Target != "" {
+            target := c.slotOf(n.GetScope(), n.Target)
+            site.target = &target
+        }
+
+        c.program.calls = append(c.program.calls, site)
+        c.jumpTo(c.emit(Instruction{Op: OpCall, Arg: len(c.program.calls) - 1}), fn.Next(), 0)
+    case *ReturnNode:
+        switch {
+        case n.Function.Result.Name == "":
+            c.emitConstant(nil)
+        case n.expression == nil:
+            c.emit(Instruction{Op: OpLoadRaw, Arg: c.variableOf(n.GetScope(), n.Function.Result.Name)})
+        default:
+            err := c.compileExpression(n.expression, n.GetScope())
+            if err != nil {
+                return err
+            }
+            c.emit(Instruction{Op: OpResult})
+        }
+
+        c.emit(Instruction{Op: OpReturn})
+    case *LoopNode:
+        err := c.compileExpression(n.expression, n.GetScope())
+        if err != nil {
+            return err
+        }
+
+        c.jumpTo(c.emit(Instruction{Op: OpBranch}), n.nextAfterEndNode, 0)
+    case *ForNode:
+        for _, bound := range []*Expression{n.start, n.limit, n.step} {
+            if bound == nil {
+                c.emitConstant(float64(1))
+                continue
+            }
+
+            err := c.compileExpression(bound, n.GetScope())
+            if err != nil {
+                return err
+            }
+            c.emit(Instruction{Op: OpNumber})
+        }
+
+        loop := c.loop(n, n.BodyScope, n.Variable, forLimitVariable, forStepVariable)
+        c.jumpTo(c.emit(Instruction{Op: OpFor, Arg: loop}), n.nextAfterEndNode, 0)
+    case *ForEachNode:
+        err := c.compileExpression(n.expression, n.GetScope())
+        if err != nil {
+            return err
+        }
+
+        loop := c.loop(n, n.BodyScope, n.Variable, forEachItemsVariable, forEachIndexVariable)
+        c.jumpTo(c.emit(Instruction{Op: OpForEach, Arg: loop}), n.nextAfterEndNode, 0)
+    case *BreakNode:
+        c.jumpTo(c.emit(Instruction{Op: OpJump}), n.Loop.AfterEnd(), 0)
+    case *ContinueNode:
+        // The end of a loop starts its next iteration
+        c.jumpTo(c.emit(Instruction{Op: OpJump}), findNextEndNode(n.Loop), 0)
+    case *ConditionNode:
+        for branch := n.nextBranch; ; {
+            elseNode, ok := branch.(*ElseNode)
+            if !ok {
+                break
+            }
+            c.conditions[elseNode] = n
+            branch = elseNode.nextBranch
+        }
+
+        err := c.compileExpression(n.expression, n.GetScope())
+        if err != nil {
+            return err
+        }
+
+        c.branchTo(c.emit(Instruction{Op: OpBranch}), n.nextBranch)
+    case *ElseNode:
+        // Reaching an else in sequence means the previous branch was taken
+        c.jumpTo(c.emit(Instruction{Op: OpJump}), n.nextAfterEnd, 0)
+
+        if n.expression != nil {
+            // Like in the tree walker, a failing elseif is reported at its if
+            c.node = c.conditions[n]
+
+            err := c.compileExpression(n.expression, n.GetScope())
+            if err != nil {
+                return err
+            }
+
+            c.branchTo(c.emit(Instruction{Op: OpBranch}), n.nextBranch)
+        }
+    case *CatchNode:
+        if n.Variable != "" {
+            if _, ok := n.BodyScope.resolveSlot(n.Variable); ok {
+                c.program.catches[n] = c.slotOf(n.BodyScope, n.Variable)
+            }
+        }
+
+        c.jumpTo(c.emit(Instruction{Op: OpJump}), n.nextAfterEnd, 0)
+    case *BlockEndNode:
+        switch loop := n.companionNode.(type) {
+        case *LoopNode:
+            c.jumpTo(c.emit(Instruction{Op: OpJump}), loop, 0)
+        case *ForNode:
+            c.jumpTo(c.emit(Instruction{Op: OpForNext, Arg: c.loops[loop]}), loop.Next(), 0)
+        case *ForEachNode:
+            c.jumpTo(c.emit(Instruction{Op: OpForEachNext, Arg: c.loops[loop]}), loop.Next(), 0)
+        }
+
+        if n.endsFunction != nil {
+            ins := Instruction{Op: OpEnd, Arg: -1}
+            if name := n.endsFunction.Result.Name; name != "" {
+                if _, ok := n.GetScope().resolveSlot(name); ok {
+                    ins.Arg = c.variableOf(n.GetScope(), name)
+                }
+            }
+            c.emit(ins)
+        }
+    case *SetNode:
+        return c.compileSet(n)
+    case *OutputNode:
+        return c.compileOutput(n)
+    case *AppendNode:
+        return c.compileCollectionUpdate(n.list, n.expression, OpList, OpAppend, "append: " + n.Parameter[0].GetRaw() + " is not a list")
+    case *DeleteNode:
+        return c.compileCollectionUpdate(n.target, n.key, OpMap, OpDelete, "delete: " + n.Parameter[0].GetRaw() + " is not a map")
+    case statementNode:
+        c.emitStatement(n)
+    default:
+        return fmt.Errorf("Can't compile %T to bytecode", node)
+    }
+
+    return nil
+}
+
+// emitStatement makes the machine run a statement as it is
+func (c *bytecodeCompiler) emitStatement(n statementNode) {
+    c.program.statements = append(c.program.statements, compiledStatement{statement: n, scope: c.program.scopeIndex[n.GetScope()]})
+    c.emit(Instruction{Op: OpRun, Arg: len(c.program.statements) - 1})
+}
+
+func (c *bytecodeCompiler) compileSet(n *SetNode) error {
+    scope := n.GetScope()
+
+    if t, _ := scope.staticType(n.Keyword); !n.declared || (len(n.path) == 0 && (n.expression == nil || t == "")) {
+        // Strings are set by concatenating the parameters, which only
+        // applies to untyped variables if they hold a string at runtime
+        c.emitStatement(n)
+        return nil
+    }
+
+    variable := c.variableOf(scope, n.Keyword)
+
+    if len(n.path) == 0 {
+        err := c.compileExpression(n.expression, scope)
+        if err != nil {
+            return err
+        }
+
+        c.emit(Instruction{Op: OpAssign, Arg: variable})
+        return nil
+    }
+
+    c.emit(Instruction{Op: OpLoadRaw, Arg: variable})
+
+    for i, element := range n.path {
+        last := i == len(n.path) - 1
+
+        if element.index == nil {
+            field := c.constant(element.field)
+            if !last {
+                c.emit(Instruction{Op: OpPathField, Arg: field})
+                continue
+            }
+
+            c.emit(Instruction{Op: OpFieldSetter})
+            err := c.compileExpression(n.expression, scope)
+            if err != nil {
+                return err
+            }
+            c.emit(Instruction{Op: OpSetField, Arg: field})
+            continue
+        }
+
+        err := c.compileExpression(element.index, scope)
+        if err != nil {
+            return err
+        }
+
+        if !last {
+            c.emit(Instruction{Op: OpPathIndex})
+            continue
+        }
+
+        c.emit(Instruction{Op: OpIndexSetter})
+        err = c.compileExpression(n.expression, scope)
+        if err != nil {
+            return err
+        }
+        c.emit(Instruction{Op: OpSetIndex})
+    }
+
+    return nil
+}
+
+func (c *bytecodeCompiler) compileOutput(n *OutputNode) error {
+    for i, parameter := range n.Parameter {
+        if i != 0 {
+            c.print(" ")
+        }
+
+        switch p := parameter.(type) {
+        case *ExpressionParameter:
+            err := c.compileExpression(p.expression, n.GetScope())
+            if err != nil {
+                return err
+            }
+            c.emit(Instruction{Op: OpWrite})
+        case *VariableParameter:
+            // Variables that aren't declared are printed as nothing
+            if p.resolved {
+                c.emit(Instruction{Op: OpLoadRaw, Arg: c.variable(n.GetScope(), p.slot, p.Text)})
+                c.emit(Instruction{Op: OpWrite})
+            }
+        default:
+            c.print(p.GetText(nil))
+        }
+    }
+
+    c.emit(Instruction{Op: OpNewline})
+
+    return nil
+}
+
+// compileCollectionUpdate compiles append and delete, the target is checked
+// by check before the value is evaluated
+func (c *bytecodeCompiler) compileCollectionUpdate(target, value *Expression, check, update Opcode, message string) error {
+    scope := c.node.GetScope()
+
+    err := c.compileExpression(target, scope)
+    if err != nil {
+        return err
+    }
+
+    c.emit(Instruction{Op: check, Arg: c.constant(message)})
+
+    err = c.compileExpression(value, scope)
+    if err != nil {
+        return err
+    }
+
+    c.emit(Instruction{Op: update})
+
+    return nil
+}
+
+// compileParameter pushes the value of a call argument, like evaluateParameter
+func (c *bytecodeCompiler) compileParameter(parameter IParameter, scope *Scope) error {
+    switch p := parameter.(type) {
+    case *ExpressionParameter:
+        return c.compileExpression(p.expression, scope)
+    case *VariableParameter:
+        if !p.resolved {
+            c.emitConstant("")
+            return nil
+        }
+        c.emit(Instruction{Op: OpLoadParameter, Arg: c.variable(scope, p.slot, p.Text)})
+    case nil:
+        c.emitConstant(nil)
+    default:
+        c.emitConstant(p.GetValue(nil))
+    }
+
+    return nil
+}
+
+// compileExpression pushes the value of an expression whose variables were
+// resolved in scope
+func (c *bytecodeCompiler) compileExpression(expression *Expression, scope *Scope) error {
+    err := c.compileExpr(expression.Root, scope)
+    if err != nil {
+        return err
+    }
+
+    if c.program.traceEval {
+        c.emit(Instruction{Op: OpTrace, Arg: c.constant(expression.ExprString)})
+    }
+
+    return nil
+}
+
+func (c *bytecodeCompiler) compileExpr(e exprNode, scope *Scope) error {
+    switch e := e.(type) {
+    case *literalExpr:
+        c.emitConstant(e.value)
+    case *variableExpr:
+        c.emit(Instruction{Op: OpLoad, Arg: c.variable(scope, e.slot, e.name)})
+    case *unaryExpr:
+        err := c.compileExpr(e.operand, scope)
+        if err != nil {
+            return err
+        }
+
+        ins := Instruction{Op: OpNot}
+        for i, operator := range unaryOperators {
+            if operator == e.operator {
+                ins.Op += Opcode(i)
+            }
+        }
+
+        c.emit(ins)
+    case *binaryExpr:
+        err := c.compileExpr(e.left, scope)
+        if err != nil {
+            return err
+        }
+
+        err = c.compileExpr(e.right, scope)
+        if err != nil {
+            return err
+        }
+
+        ins := Instruction{Op: OpAdd}
+        for i, operator := range binaryOperators {
+            if operator == e.operator {
+                ins.Op += Opcode(i)
+            }
+        }
+        if e.leftWhole {
+            ins.Arg |= 1
+        }
+        if e.rightWhole {
+            ins.Arg |= 2
+        }
+
+        c.emit(ins)
+    case *logicalExpr:
+        err := c.compileExpr(e.left, scope)
+        if err != nil {
+            return err
+        }
+
+        ins := Instruction{Op: OpAnd}
+        if e.operator == "||" {
+            ins.Op = OpOr
+        }
+        at := c.emit(ins)
+
+        err = c.compileExpr(e.right, scope)
+        if err != nil {
+            return err
+        }
+
+        c.emit(Instruction{Op: OpLogical, Arg: int(ins.Op - OpAnd)})
+        c.program.Code[at].Jump = len(c.program.Code)
+    case *callExpr:
+        for _, argument := range e.arguments {
+            err := c.compileExpr(argument, scope)
+            if err != nil {
+                return err
+            }
+        }
+
+        c.program.builtins = append(c.program.builtins, builtinCall{name: e.name, function: e.function, arguments: len(e.arguments)})
+        c.emit(Instruction{Op: OpBuiltin, Arg: len(c.program.builtins) - 1})
+    case *indexExpr:
+        err := c.compileExpr(e.target, scope)
+        if err != nil {
+            return err
+        }
+
+        err = c.compileExpr(e.key, scope)
+        if err != nil {
+            return err
+        }
+
+        c.emit(Instruction{Op: OpIndex})
+    case *fieldExpr:
+        err := c.compileExpr(e.target, scope)
+        if err != nil {
+            return err
+        }
+
+        c.emit(Instruction{Op: OpField, Arg: c.constant(e.field)})
+    default:
+        return fmt.Errorf("Can't compile %T to bytecode", e)
+    }
+
+    return nil
+}
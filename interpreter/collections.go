@@ -0,0 +1,219 @@
+package interpreter
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "sort"
+    "unicode/utf8"
+)
+
+// List is the value of a list variable. Lists are passed by reference.
+type List struct {
+    Items []interface{}
+}
+
+func NewList() *List {
+    return &List{}
+}
+
+func (list *List) Len() int {
+    return len(list.Items)
+}
+
+func (list *List) Append(value interface{}) {
+    list.Items = append(list.Items, value)
+}
+
+// Index implements Indexable, so lists can be indexed in expressions
+func (list *List) Index(key interface{}) (interface{}, error) {
+    i, err := list.position(key)
+    if err != nil {
+        return nil, err
+    }
+
+    return list.Items[i], nil
+}
+
+func (list *List) SetIndex(key, value interface{}) error {
+    i, err := list.position(key)
+    if err != nil {
+        return err
+    }
+
+    list.Items[i] = value
+
+    return nil
+}
+
+func (list *List) String() string {
+    return formatValue(list)
+}
+
+func (list *List) format(outer []interface{}) string {
+    str := "["
+    for i, item := range list.Items {
+        if i > 0 {
+            str += ", "
+        }
+        str += formatNestedElement(item, outer)
+    }
+
+    return str + "]"
+}
+
+func (list *List) position(key interface{}) (int, error) {
+    if i, ok := key.(int64); ok {
+        key = float64(i)
+    }
+
+    index, ok := key.(float64)
+    if !ok || index != math.Trunc(index) {
+        return 0, fmt.Errorf("List index %v is not a whole number", key)
+    }
+
+    if index < 0 || int(index) >= len(list.Items) {
+        return 0, fmt.Errorf("List index %v out of range (length %d)", index, len(list.Items))
+    }
+
+    return int(index), nil
+}
+
+// Map is the value of a map variable, it maps strings to values of any type.
+// Like lists, maps are passed by reference.
+type Map struct {
+    Entries map[string]interface{}
+}
+
+func NewMap() *Map {
+    return &Map{Entries: make(map[string]interface{})}
+}
+
+func (m *Map) Len() int {
+    return len(m.Entries)
+}
+
+// Index implements Indexable, so maps can be accessed in expressions
+func (m *Map) Index(key interface{}) (interface{}, error) {
+    k, err := mapKey(key)
+    if err != nil {
+        return nil, err
+    }
+
+    value, ok := m.Entries[k]
+    if !ok {
+        return nil, fmt.Errorf("Key \"%s\" not found in map", k)
+    }
+
+    return value, nil
+}
+
+func (m *Map) SetIndex(key, value interface{}) error {
+    k, err := mapKey(key)
+    if err != nil {
+        return err
+    }
+
+    m.Entries[k] = value
+
+    return nil
+}
+
+func (m *Map) Has(key interface{}) (bool, error) {
+    k, err := mapKey(key)
+    if err != nil {
+        return false, err
+    }
+
+    _, ok := m.Entries[k]
+
+    return ok, nil
+}
+
+func (m *Map) Delete(key interface{}) error {
+    k, err := mapKey(key)
+    if err != nil {
+        return err
+    }
+
+    delete(m.Entries, k)
+
+    return nil
+}
+
+// Keys returns all keys in sorted order, so iterating a map is deterministic
+func (m *Map) Keys() []string {
+    keys := make([]string, 0, len(m.Entries))
+    for k := range m.Entries {
+        keys = append(keys, k)
+    }
+
+    sort.Strings(keys)
+
+    return keys
+}
+
+func (m *Map) String() string {
+    return formatValue(m)
+}
+
+func (m *Map) format(outer []interface{}) string {
+    str := "{"
+    for i, k := range m.Keys() {
+        if i > 0 {
+            str += ", "
+        }
+        str += formatElement(k) + ": " + formatNestedElement(m.Entries[k], outer)
+    }
+
+    return str + "}"
+}
+
+func mapKey(key interface{}) (string, error) {
+    k, ok := key.(string)
+    if !ok {
+        return "", fmt.Errorf("Map key %s is not a string", formatElement(key))
+    }
+
+    return k, nil
+}
+
+// IndexSetter is implemented by values that support "var[key] = value"
+type IndexSetter interface {
+    SetIndex(key, value interface{}) error
+}
+
+func builtinLen(arguments ...interface{}) (interface{}, error) {
+    if len(arguments) != 1 {
+        return nil, errors.New("len() takes exactly one parameter")
+    }
+
+    switch v := arguments[0].(type) {
+    case *List:
+        return int64(v.Len()), nil
+    case *Map:
+        return int64(v.Len()), nil
+    case string:
+        return int64(utf8.RuneCountInString(v)), nil
+    }
+
+    return nil, fmt.Errorf("len() can't be used on %s", typeOf(arguments[0]))
+}
+
+func builtinHas(arguments ...interface{}) (interface{}, error) {
+    if len(arguments) != 2 {
+        return nil, errors.New("has() takes a map and a key as parameters")
+    }
+
+    m, ok := arguments[0].(*Map)
+    if !ok {
+        return nil, fmt.Errorf("has() can't be used on %s", typeOf(arguments[0]))
+    }
+
+    found, err := m.Has(arguments[1])
+    if err != nil {
+        return nil, err
+    }
+
+    return found, nil
+}
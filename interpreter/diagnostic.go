@@ -0,0 +1,148 @@
+package interpreter
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "unicode/utf8"
+)
+
+type Severity int
+
+const (
+    SeverityError Severity = iota
+    SeverityWarning
+)
+
+func (severity Severity) String() string {
+    if severity == SeverityWarning {
+        return "warning"
+    }
+
+    return "error"
+}
+
+// Diagnostic is a problem found while compiling a script, pointing at the
+// place in the source it was found at.
+type Diagnostic struct {
+    File string
+    Line int
+    Column int
+    Severity Severity
+    Message string
+    // Source is the line of the script the diagnostic points at
+    Source string
+    // Length is the number of characters to underline, at least 1
+    Length int
+}
+
+// NewDiagnostic creates an error diagnostic underlining token
+func NewDiagnostic(token Token, message string) Diagnostic {
+    return Diagnostic{File: token.File, Line: token.Line, Column: token.Column, Severity: SeverityError, Message: message, Source: token.Source, Length: utf8.RuneCountInString(token.Text)}
+}
+
+func (d Diagnostic) Error() string {
+    return fmt.Sprintf("%s:%d:%d: %s: %s", d.File, d.Line, d.Column, d.Severity, d.Message)
+}
+
+// Render formats the diagnostic followed by the source line, with the
+// position it refers to underlined.
+func (d Diagnostic) Render() string {
+    text := d.Error()
+
+    if d.Source == "" || d.Column < 1 {
+        return text
+    }
+
+    // Tabs are kept so the caret lines up with the source above it
+    var pad strings.Builder
+    for i, c := range d.Source {
+        if utf8.RuneCountInString(d.Source[:i]) >= d.Column - 1 {
+            break
+        }
+        if c == '\t' {
+            pad.WriteRune('\t')
+        } else {
+            pad.WriteRune(' ')
+        }
+    }
+
+    length := d.Length
+    if length < 1 {
+        length = 1
+    }
+
+    return text + "\n    " + d.Source + "\n    " + pad.String() + "^" + strings.Repeat("~", length - 1)
+}
+
+// Diagnostics is a list of problems, it is returned as an error when
+// compiling a script fails.
+type Diagnostics []Diagnostic
+
+func (ds Diagnostics) Error() string {
+    rendered := make([]string, len(ds))
+    for i, d := range ds {
+        rendered[i] = d.Render()
+    }
+
+    return strings.Join(rendered, "\n")
+}
+
+// HasErrors reports whether any of the diagnostics is an error, as opposed
+// to only warnings
+func (ds Diagnostics) HasErrors() bool {
+    for _, d := range ds {
+        if d.Severity == SeverityError {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (ds *Diagnostics) add(token Token, message string) {
+    *ds = append(*ds, NewDiagnostic(token, message))
+}
+
+// addError adds err at token, unless it is a Diagnostic pointing at a more
+// precise position already
+func (ds *Diagnostics) addError(token Token, err error) {
+    if d, ok := err.(Diagnostic); ok {
+        *ds = append(*ds, d)
+        return
+    }
+
+    ds.add(token, err.Error())
+}
+
+// prefixError puts prefix in front of the message of err, keeping the
+// position of Diagnostics
+func prefixError(prefix string, err error) error {
+    if d, ok := err.(Diagnostic); ok {
+        d.Message = prefix + d.Message
+        return d
+    }
+
+    return errors.New(prefix + err.Error())
+}
+
+// sort orders the diagnostics by their position, keeping the order of
+// diagnostics at the same position
+func (ds Diagnostics) sort() {
+    sort.Stable(byPosition(ds))
+}
+
+type byPosition Diagnostics
+
+func (ds byPosition) Len() int { return len(ds) }
+func (ds byPosition) Swap(i, j int) { ds[i], ds[j] = ds[j], ds[i] }
+func (ds byPosition) Less(i, j int) bool {
+    if ds[i].File != ds[j].File {
+        return ds[i].File < ds[j].File
+    }
+    if ds[i].Line != ds[j].Line {
+        return ds[i].Line < ds[j].Line
+    }
+    return ds[i].Column < ds[j].Column
+}
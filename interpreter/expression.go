@@ -1,64 +1,200 @@
 package interpreter
 
 import (
-	"strings"
 	"errors"
 	"fmt"
-
-	"github.com/Knetic/govaluate"
+	"io"
 )
 
-var VerboseEval bool
-
+// Expression is a parsed expression. Its variables are resolved against the
+// scope it is used in, Type is the static type of its value, or empty if it
+// is only known at runtime.
 type Expression struct {
-	Expr *govaluate.EvaluableExpression
+	Root exprNode
+	Type string
 	ExprString string
 }
 
-func Evaluate(node INode, expression *Expression) (float64, error) {
+func Evaluate(state *XiiState, scope Variables, expression *Expression) (float64, error) {
+
+	result, err := EvaluateValue(state, scope, expression)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return numberValue(result)
+}
+
+// numberValue converts the result of an expression evaluated as a number.
+// Conditions are evaluated as numbers, true is 1 and false is 0.
+func numberValue(result interface{}) (float64, error) {
+	if b, ok := result.(bool); ok {
+		if b {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	if i, ok := result.(int64); ok {
+		return float64(i), nil
+	}
+
+	v, ok := result.(float64)
+	if !ok {
+		return 0, errors.New("Unexpected expression evaluation result")
+	}
+
+	return v, nil
+}
+
+// EvaluateValue evaluates an expression to a value of any XiiLang type. Unlike
+// Evaluate, booleans are returned as they are. The evaluation is traced to
+// the StdErr of state if its VerboseEval is set, state may be nil.
+func EvaluateValue(state *XiiState, scope Variables, expression *Expression) (interface{}, error) {
 
-	result, err := expression.Expr.Evaluate(node.GetScope())
+	result, err := expression.Root.eval(scope)
 
-	if VerboseEval {
-		fmt.Printf("Evaluated expression: %s -> %s\n", expression.ExprString, result)
+	if state != nil && state.VerboseEval {
+		traceEvaluation(state.StdErr, expression.ExprString, result)
 	}
 
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	switch v := result.(type) {
-	case float64:
+	case float64, int64, string, bool, *List, *Map, *Struct:
 		return v, nil
-	case bool:
-		if v {
-			return float64(1), nil
-		}
-		return float64(0), nil
 	}
 
-	return 0, errors.New("Unexpected expression evaluation result")
+	return nil, errors.New("Unexpected expression evaluation result")
 }
 
-func NewExpression(condition []IParameter) (*Expression, error) {
-	var str string
+// builtinFunctions can be called from every expression
+var builtinFunctions = map[string]builtinFunction{
+	"len":        builtinLen,
+	"has":        builtinHas,
+	"int":        builtinInt,
+	"number":     builtinNumber,
+	"substr":     builtinSubstr,
+	"indexOf":    builtinIndexOf,
+	"split":      builtinSplit,
+	"join":       builtinJoin,
+	"replace":    builtinReplace,
+	"upper":      builtinUpper,
+	"lower":      builtinLower,
+	"trim":       builtinTrim,
+	"startsWith": builtinStartsWith,
+	"format":     builtinFormat,
+}
+
+// builtinResultTypes holds the static types of the values returned by the builtinFunctions
+var builtinResultTypes = map[string]string{
+	"len":        "int",
+	"has":        "bool",
+	"int":        "int",
+	"number":     "number",
+	"substr":     "string",
+	"indexOf":    "int",
+	"split":      "list",
+	"join":       "string",
+	"replace":    "string",
+	"upper":      "string",
+	"lower":      "string",
+	"trim":       "string",
+	"startsWith": "bool",
+	"format":     "string",
+}
+
+// NewExpression parses the parameters as one expression, with its variables
+// resolved in scope
+func NewExpression(condition []IParameter, scope *Scope) (*Expression, error) {
+	var tokens []Token
 	for _, param := range condition {
-		str += param.GetRaw() + " "
+		if p, ok := param.(tokenizedParameter); ok {
+			tokens = append(tokens, p.sourceTokens()...)
+		}
 	}
 
-	if strings.TrimSpace(str) == "" {
-		return nil, errors.New("Empty expression passed")
+	return newExpressionFromTokens(tokens, scope)
+}
+
+// NewExpressionFromString parses the source of an expression, with its
+// variables resolved in scope
+func NewExpressionFromString(str string, scope *Scope) (*Expression, error) {
+	tokens, err := scanExpression(str)
+	if err != nil {
+		return nil, err
 	}
 
-	expr, err := govaluate.NewEvaluableExpression(str)
+	return newExpressionFromTokens(tokens, scope)
+}
+
+func newExpressionFromTokens(tokens []Token, scope *Scope) (*Expression, error) {
+	expression, err := parseExpressionFromTokens(tokens)
+	if err != nil {
+		return nil, err
+	}
 
+	err = expression.resolve(scope)
 	if err != nil {
 		return nil, err
 	}
 
-	if VerboseEval {
-		fmt.Println("Created expression: " + str)
+	return expression, nil
+}
+
+// parseExpressionFromTokens only parses an expression, its variables have to
+// be resolved before it is evaluated. This is used where the scope is not
+// complete yet while parsing.
+func parseExpressionFromTokens(tokens []Token) (*Expression, error) {
+	root, err := parseExpressionTokens(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Expression{Root: root, ExprString: joinWords(tokens).Text}, nil
+}
+
+// traceEvaluation writes a line of the eval trace
+func traceEvaluation(w io.Writer, source interface{}, result interface{}) {
+	fmt.Fprintf(w, "Evaluated expression: %s -> %s\n", source, result)
+}
+
+// traceExpressions writes the expressions of the parsed nodes to w, they
+// are traced again whenever they are evaluated
+func traceExpressions(w io.Writer, nodes []INode) {
+	for _, node := range nodes {
+		for _, expression := range nodeExpressions(node) {
+			fmt.Fprintln(w, "Created expression: " + expression.ExprString)
+		}
+	}
+}
+
+// scanExpression splits the source of an expression into tokens
+func scanExpression(str string) ([]Token, error) {
+	var diagnostics Diagnostics
+	tokens := scanLine("expression", 1, str, &diagnostics)
+	if len(diagnostics) > 0 {
+		return nil, diagnostics
 	}
 
-	return &Expression{Expr: expr, ExprString: str}, nil
+	if len(tokens) == 0 {
+		return nil, errors.New("Empty expression passed")
+	}
+
+	return tokens, nil
+}
+
+// resolve checks the variables of the expression against scope and sets its type
+func (expression *Expression) resolve(scope *Scope) error {
+	t, err := expression.Root.resolve(scope)
+	if err != nil {
+		return err
+	}
+
+	expression.Type = t
+
+	return nil
 }
\ No newline at end of file
@@ -0,0 +1,386 @@
+package interpreter
+
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+// wordOperators are the operators written as words, mapped to their symbols
+var wordOperators = map[string]string{
+    "and": "&&",
+    "or": "||",
+    "not": "!",
+    "xor": "xor",
+}
+
+// parseNumber returns the value of a number literal, whole numbers too large
+// to be represented exactly as a float are kept as ints
+func parseNumber(text string) interface{} {
+    integer, err := strconv.ParseInt(text, 10, 64)
+    if err == nil && (integer > 1 << 53 || integer < -(1 << 53)) {
+        return integer
+    }
+
+    value, _ := strconv.ParseFloat(text, 64)
+    return value
+}
+
+// exprParser is a recursive descent parser over the tokens of an
+// expression, each level of precedence has its own method. From the lowest
+// to the highest precedence:
+//
+//  ||
+//  &&
+//  == != < > <= >=
+//  + - | xor
+//  * / % & << >>
+//  ^ (right associative)
+//  prefix - ! ~
+//  indices, fields, calls and brackets
+//
+// Errors are returned as Diagnostics pointing at the token they were found at.
+type exprParser struct {
+    tokens []Token
+    position int
+    // end stands for the end of the expression, right behind its last token
+    end Token
+}
+
+func newExprParser(tokens []Token) *exprParser {
+    p := &exprParser{tokens: splitSigns(tokens)}
+
+    last := tokens[len(tokens) - 1]
+    p.end = last
+    p.end.Column += utf8.RuneCountInString(last.Text)
+    p.end.Text = ""
+
+    return p
+}
+
+// parseExpressionTokens parses the tokens of an expression into a tree,
+// variables are resolved later by resolveExpression
+func parseExpressionTokens(tokens []Token) (exprNode, error) {
+    if len(tokens) == 0 {
+        return nil, errors.New("Empty expression passed")
+    }
+
+    p := newExprParser(tokens)
+
+    node, err := p.parseOr()
+    if err != nil {
+        return nil, err
+    }
+
+    if !p.done() {
+        return nil, p.unexpected(p.peek())
+    }
+
+    return node, nil
+}
+
+// splitSigns separates the sign from negative number literals, in
+// expressions the minus is an operator, so n -1 is n - 1
+func splitSigns(tokens []Token) []Token {
+    split := make([]Token, 0, len(tokens))
+    for _, token := range tokens {
+        if token.Kind != TokenNumber || !strings.HasPrefix(token.Text, "-") {
+            split = append(split, token)
+            continue
+        }
+
+        sign := token
+        sign.Kind = TokenOperator
+        sign.Text = "-"
+
+        number := token
+        number.Text = token.Text[1:]
+        number.Column++
+
+        split = append(split, sign, number)
+    }
+
+    return split
+}
+
+func (p *exprParser) done() bool {
+    return p.position >= len(p.tokens)
+}
+
+// peek returns the next token, or the end of the expression if there is none
+func (p *exprParser) peek() Token {
+    if p.done() {
+        return p.end
+    }
+
+    return p.tokens[p.position]
+}
+
+func (p *exprParser) next() Token {
+    token := p.peek()
+    p.position++
+
+    return token
+}
+
+// operator returns the operator a token stands for, word operators are
+// returned as their symbols
+func operator(token Token) (string, bool) {
+    switch token.Kind {
+    case TokenOperator:
+        return token.Text, true
+    case TokenIdentifier:
+        symbol, ok := wordOperators[token.Text]
+        return symbol, ok
+    }
+
+    return "", false
+}
+
+// acceptOperator consumes the next token if it is one of operators
+func (p *exprParser) acceptOperator(operators ...string) (string, bool) {
+    if p.done() {
+        return "", false
+    }
+
+    text, ok := operator(p.peek())
+    if !ok {
+        return "", false
+    }
+
+    for _, operator := range operators {
+        if text == operator {
+            p.position++
+            return operator, true
+        }
+    }
+
+    return "", false
+}
+
+func (p *exprParser) expectOperator(operator string, message string) error {
+    if _, ok := p.acceptOperator(operator); !ok {
+        return p.errorAt(p.peek(), message)
+    }
+
+    return nil
+}
+
+func (p *exprParser) errorAt(token Token, message string) error {
+    return NewDiagnostic(token, message)
+}
+
+func (p *exprParser) unexpected(token Token) error {
+    if token.Text == "" {
+        return p.errorAt(token, "Unexpected end of expression")
+    }
+
+    return p.errorAt(token, fmt.Sprintf("Unexpected '%s' in expression", token.Text))
+}
+
+// parseBinary parses a left associative chain of operators, with operands
+// parsed by operand
+func (p *exprParser) parseBinary(operand func() (exprNode, error), operators ...string) (exprNode, error) {
+    left, err := operand()
+    if err != nil {
+        return nil, err
+    }
+
+    for {
+        operator, ok := p.acceptOperator(operators...)
+        if !ok {
+            return left, nil
+        }
+
+        right, err := operand()
+        if err != nil {
+            return nil, err
+        }
+
+        switch operator {
+        case "&&", "||":
+            left = &logicalExpr{operator: operator, left: left, right: right}
+        default:
+            left = &binaryExpr{operator: operator, left: left, right: right}
+        }
+    }
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+    return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+    return p.parseBinary(p.parseComparison, "&&")
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+    return p.parseBinary(p.parseAdditive, "==", "!=", "<", ">", "<=", ">=")
+}
+
+func (p *exprParser) parseAdditive() (exprNode, error) {
+    return p.parseBinary(p.parseMultiplicative, "+", "-", "|", "xor")
+}
+
+func (p *exprParser) parseMultiplicative() (exprNode, error) {
+    return p.parseBinary(p.parseExponent, "*", "/", "%", "&", "<<", ">>")
+}
+
+func (p *exprParser) parseExponent() (exprNode, error) {
+    base, err := p.parsePrefix()
+    if err != nil {
+        return nil, err
+    }
+
+    if _, ok := p.acceptOperator("^"); !ok {
+        return base, nil
+    }
+
+    exponent, err := p.parseExponent()
+    if err != nil {
+        return nil, err
+    }
+
+    return &binaryExpr{operator: "^", left: base, right: exponent}, nil
+}
+
+func (p *exprParser) parsePrefix() (exprNode, error) {
+    operator, ok := p.acceptOperator("-", "!", "~")
+    if !ok {
+        return p.parsePostfix()
+    }
+
+    operand, err := p.parsePrefix()
+    if err != nil {
+        return nil, err
+    }
+
+    return &unaryExpr{operator: operator, operand: operand}, nil
+}
+
+// parsePostfix parses a value followed by any number of indices and fields
+func (p *exprParser) parsePostfix() (exprNode, error) {
+    value, err := p.parseValue()
+    if err != nil {
+        return nil, err
+    }
+
+    return p.parseSelectors(value)
+}
+
+// parseSelectors parses the indices and fields following value
+func (p *exprParser) parseSelectors(value exprNode) (exprNode, error) {
+    for {
+        operator, ok := p.acceptOperator("[", ".")
+        if !ok {
+            return value, nil
+        }
+
+        if operator == "." {
+            name := p.next()
+            if name.Kind != TokenIdentifier {
+                return nil, p.errorAt(name, "Missing field name after '.'")
+            }
+
+            value = &fieldExpr{target: value, field: name.Text}
+            continue
+        }
+
+        key, err := p.parseOr()
+        if err != nil {
+            return nil, err
+        }
+
+        err = p.expectOperator("]", "Unbalanced index brackets")
+        if err != nil {
+            return nil, err
+        }
+
+        value = &indexExpr{target: value, key: key}
+    }
+}
+
+func (p *exprParser) parseValue() (exprNode, error) {
+    if p.done() {
+        return nil, p.unexpected(p.end)
+    }
+
+    token := p.next()
+
+    switch token.Kind {
+    case TokenNumber:
+        return &literalExpr{value: parseNumber(token.Text)}, nil
+    case TokenString:
+        return &literalExpr{value: token.Value}, nil
+    case TokenIdentifier:
+        if _, ok := wordOperators[token.Text]; ok {
+            break
+        }
+
+        switch token.Text {
+        case "true":
+            return &literalExpr{value: true}, nil
+        case "false":
+            return &literalExpr{value: false}, nil
+        }
+
+        if _, ok := p.acceptOperator("("); ok {
+            return p.parseCall(token)
+        }
+
+        return &variableExpr{name: token.Text, token: token}, nil
+    case TokenOperator:
+        if token.Text != "(" {
+            break
+        }
+
+        value, err := p.parseOr()
+        if err != nil {
+            return nil, err
+        }
+
+        err = p.expectOperator(")", "Unbalanced parenthesis")
+        if err != nil {
+            return nil, err
+        }
+
+        return value, nil
+    }
+
+    return nil, p.unexpected(token)
+}
+
+// parseCall parses the arguments of a call to a built-in function, the
+// opening bracket has already been consumed
+func (p *exprParser) parseCall(name Token) (exprNode, error) {
+    function, ok := builtinFunctions[name.Text]
+    if !ok {
+        return nil, p.errorAt(name, fmt.Sprintf("Undefined function '%s'", name.Text))
+    }
+
+    call := &callExpr{name: name.Text, function: function}
+
+    if _, ok := p.acceptOperator(")"); ok {
+        return call, nil
+    }
+
+    for {
+        argument, err := p.parseOr()
+        if err != nil {
+            return nil, err
+        }
+
+        call.arguments = append(call.arguments, argument)
+
+        if _, ok := p.acceptOperator(")"); ok {
+            return call, nil
+        }
+
+        err = p.expectOperator(",", "Function parameters have to be separated by commas")
+        if err != nil {
+            return nil, err
+        }
+    }
+}
@@ -0,0 +1,491 @@
+package interpreter
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "strings"
+)
+
+// exprNode is a node of a parsed expression
+type exprNode interface {
+    // eval computes the value of the expression using the variables in scope
+    eval(scope Variables) (interface{}, error)
+    // resolve checks that all variables and fields used exist in scope and
+    // returns the static type of the value, empty if it is only known at runtime
+    resolve(scope *Scope) (string, error)
+    // String formats the expression, with brackets around every operation
+    String() string
+}
+
+// Indexable is implemented by values that can be accessed using square
+// brackets in expressions, e.g. xs[1]
+type Indexable interface {
+    Index(key interface{}) (interface{}, error)
+}
+
+// Accessible is implemented by values whose fields can be read in
+// expressions, e.g. p.x
+type Accessible interface {
+    Field(name string) (interface{}, error)
+}
+
+type builtinFunction func(arguments ...interface{}) (interface{}, error)
+
+
+// literalExpr is a number, string or bool written in the expression
+type literalExpr struct {
+    value interface{}
+}
+
+func (e *literalExpr) eval(scope Variables) (interface{}, error) {
+    return e.value, nil
+}
+
+func (e *literalExpr) resolve(scope *Scope) (string, error) {
+    switch e.value.(type) {
+    case string:
+        return "string", nil
+    case bool:
+        return "bool", nil
+    }
+
+    return literalType(e.value), nil
+}
+
+func (e *literalExpr) String() string {
+    if s, ok := e.value.(string); ok {
+        return quoteString(s)
+    }
+
+    return formatValue(e.value)
+}
+
+
+type variableExpr struct {
+    name string
+    // token is where the variable is used, unknown variables are reported there
+    token Token
+    // slot is set by resolve, which fails for variables that aren't declared
+    slot variableSlot
+}
+
+func (e *variableExpr) eval(scope Variables) (interface{}, error) {
+    value := scope.load(e.slot)
+    if value == nil {
+        return nil, errors.New("Unknown variable " + e.name)
+    }
+
+    return value, nil
+}
+
+func (e *variableExpr) resolve(scope *Scope) (string, error) {
+    t, declared := scope.staticType(e.name)
+    if !declared {
+        return "", NewDiagnostic(e.token, "Unknown variable " + e.name)
+    }
+
+    e.slot, _ = scope.resolveSlot(e.name)
+
+    return t, nil
+}
+
+func (e *variableExpr) String() string {
+    return e.name
+}
+
+
+// unaryExpr is one of the prefix operators - ! and ~
+type unaryExpr struct {
+    operator string
+    operand exprNode
+}
+
+func (e *unaryExpr) eval(scope Variables) (interface{}, error) {
+    value, err := e.operand.eval(scope)
+    if err != nil {
+        return nil, err
+    }
+
+    return applyUnary(e.operator, value)
+}
+
+// applyUnary applies one of the prefix operators to a value
+func applyUnary(operator string, value interface{}) (interface{}, error) {
+    switch operator {
+    case "!":
+        b, ok := value.(bool)
+        if !ok {
+            return nil, fmt.Errorf("Value '%s' cannot be inverted, it is not a bool", formatElement(value))
+        }
+        return !b, nil
+    case "-":
+        switch number := value.(type) {
+        case float64:
+            return -number, nil
+        case int64:
+            if number == math.MinInt64 {
+                return nil, errors.New("Integer overflow")
+            }
+            return -number, nil
+        }
+        return nil, fmt.Errorf("Value '%s' cannot be negated, it is not a number", formatElement(value))
+    }
+
+    number, ok := asInt(value, true)
+    if !ok {
+        return nil, fmt.Errorf("Value '%s' cannot be used with the operator '~', it is not an int", formatElement(value))
+    }
+
+    return ^number, nil
+}
+
+func (e *unaryExpr) resolve(scope *Scope) (string, error) {
+    t, err := e.operand.resolve(scope)
+    if err != nil {
+        return "", err
+    }
+
+    if e.operator == "!" {
+        if t != "" && t != "bool" {
+            return "", operatorTypeError(e.operator, t)
+        }
+        return "bool", nil
+    }
+
+    if t != "" && !isNumericType(t) {
+        return "", operatorTypeError(e.operator, t)
+    }
+
+    if e.operator == "~" {
+        return "int", nil
+    }
+
+    return t, nil
+}
+
+func (e *unaryExpr) String() string {
+    return "(" + e.operator + e.operand.String() + ")"
+}
+
+
+// binaryExpr is an arithmetic, bitwise or comparison operator
+type binaryExpr struct {
+    operator string
+    left, right exprNode
+    // leftWhole and rightWhole are set by resolve for operands that are
+    // whole number literals, which are treated like ints when combined with one
+    leftWhole, rightWhole bool
+}
+
+func (e *binaryExpr) eval(scope Variables) (interface{}, error) {
+    value, err := e.left.eval(scope)
+    if err != nil {
+        return nil, err
+    }
+
+    rightValue, err := e.right.eval(scope)
+    if err != nil {
+        return nil, err
+    }
+
+    return applyBinary(e.operator, value, rightValue, e.leftWhole, e.rightWhole)
+}
+
+// applyBinary applies a binary operator other than && and || to two values
+func applyBinary(operator string, value, rightValue interface{}, leftWhole, rightWhole bool) (interface{}, error) {
+    switch operator {
+    case "==":
+        return isEqual(value, rightValue), nil
+    case "!=":
+        return !isEqual(value, rightValue), nil
+    case "<", ">", "<=", ">=":
+        if !isNumber(value) {
+            return nil, fmt.Errorf("Value '%s' cannot be used with the comparator '%s', it is not a number", formatElement(value), operator)
+        }
+        if !isNumber(rightValue) {
+            return nil, fmt.Errorf("Value '%s' cannot be used with the comparator '%s', it is not a number", formatElement(rightValue), operator)
+        }
+
+        c := compareNumbers(value, rightValue)
+        switch operator {
+        case "<":
+            return c < 0, nil
+        case ">":
+            return c > 0, nil
+        case "<=":
+            return c <= 0, nil
+        }
+        return c >= 0, nil
+    case "+":
+        _, leftIsString := value.(string)
+        _, rightIsString := rightValue.(string)
+        if leftIsString || rightIsString {
+            return formatValue(value) + formatValue(rightValue), nil
+        }
+    }
+
+    return applyArithmetic(operator, value, rightValue, leftWhole, rightWhole)
+}
+
+func (e *binaryExpr) resolve(scope *Scope) (string, error) {
+    left, err := e.left.resolve(scope)
+    if err != nil {
+        return "", err
+    }
+
+    right, err := e.right.resolve(scope)
+    if err != nil {
+        return "", err
+    }
+
+    e.leftWhole = left == wholeType
+    e.rightWhole = right == wholeType
+
+    switch e.operator {
+    case "==", "!=":
+        return "bool", nil
+    case "+":
+        if left == "string" || right == "string" {
+            return "string", nil
+        }
+    }
+
+    // All other operators only work on numbers
+    for _, t := range []string{left, right} {
+        if t != "" && !isNumericType(t) {
+            return "", operatorTypeError(e.operator, t)
+        }
+    }
+
+    switch e.operator {
+    case "<", ">", "<=", ">=":
+        return "bool", nil
+    case "&", "|", "xor", "<<", ">>":
+        return "int", nil
+    }
+
+    return arithmeticType(left, right), nil
+}
+
+// operatorTypeError reports an operand whose static type the operator can't be used on
+func operatorTypeError(operator, t string) error {
+    return fmt.Errorf("The operator '%s' can't be used on %s", operator, describeType(t))
+}
+
+func (e *binaryExpr) String() string {
+    return "(" + e.left.String() + " " + e.operator + " " + e.right.String() + ")"
+}
+
+// arithmeticType returns the type of an arithmetic operation on two numbers
+func arithmeticType(left, right string) string {
+    if !isNumericType(left) || !isNumericType(right) {
+        return ""
+    }
+
+    if left == "number" || right == "number" {
+        return "number"
+    }
+
+    if left == "int" || right == "int" {
+        return "int"
+    }
+
+    return wholeType
+}
+
+
+// logicalExpr is && or ||, the right side is only evaluated if the left side
+// doesn't decide the result already
+type logicalExpr struct {
+    operator string
+    left, right exprNode
+}
+
+func (e *logicalExpr) eval(scope Variables) (interface{}, error) {
+    value, err := e.left.eval(scope)
+    if err != nil {
+        return nil, err
+    }
+
+    b, err := logicalOperand(e.operator, value)
+    if err != nil {
+        return nil, err
+    }
+
+    if (e.operator == "&&") != b {
+        return b, nil
+    }
+
+    value, err = e.right.eval(scope)
+    if err != nil {
+        return nil, err
+    }
+
+    if _, err := logicalOperand(e.operator, value); err != nil {
+        return nil, err
+    }
+
+    return value, nil
+}
+
+// logicalOperand checks that an operand of && or || is a bool
+func logicalOperand(operator string, value interface{}) (bool, error) {
+    b, ok := value.(bool)
+    if !ok {
+        return false, fmt.Errorf("Value '%s' cannot be used with the logical operator '%s', it is not a bool", formatElement(value), operator)
+    }
+
+    return b, nil
+}
+
+func (e *logicalExpr) resolve(scope *Scope) (string, error) {
+    for _, operand := range []exprNode{e.left, e.right} {
+        t, err := operand.resolve(scope)
+        if err != nil {
+            return "", err
+        }
+
+        if t != "" && t != "bool" {
+            return "", operatorTypeError(e.operator, t)
+        }
+    }
+
+    return "bool", nil
+}
+
+func (e *logicalExpr) String() string {
+    return "(" + e.left.String() + " " + e.operator + " " + e.right.String() + ")"
+}
+
+
+// callExpr calls one of the builtinFunctions
+type callExpr struct {
+    name string
+    function builtinFunction
+    arguments []exprNode
+}
+
+func (e *callExpr) eval(scope Variables) (interface{}, error) {
+    arguments := make([]interface{}, len(e.arguments))
+    for i, argument := range e.arguments {
+        value, err := argument.eval(scope)
+        if err != nil {
+            return nil, err
+        }
+        arguments[i] = value
+    }
+
+    return e.function(arguments...)
+}
+
+func (e *callExpr) resolve(scope *Scope) (string, error) {
+    for _, argument := range e.arguments {
+        if _, err := argument.resolve(scope); err != nil {
+            return "", err
+        }
+    }
+
+    return builtinResultTypes[e.name], nil
+}
+
+func (e *callExpr) String() string {
+    arguments := make([]string, len(e.arguments))
+    for i, argument := range e.arguments {
+        arguments[i] = argument.String()
+    }
+
+    return e.name + "(" + strings.Join(arguments, ", ") + ")"
+}
+
+
+type indexExpr struct {
+    target, key exprNode
+}
+
+func (e *indexExpr) eval(scope Variables) (interface{}, error) {
+    value, err := e.target.eval(scope)
+    if err != nil {
+        return nil, err
+    }
+
+    key, err := e.key.eval(scope)
+    if err != nil {
+        return nil, err
+    }
+
+    return indexValue(value, key)
+}
+
+func indexValue(value, key interface{}) (interface{}, error) {
+    indexable, ok := value.(Indexable)
+    if !ok {
+        return nil, fmt.Errorf("Value '%s' cannot be indexed", formatElement(value))
+    }
+
+    return indexable.Index(key)
+}
+
+func (e *indexExpr) resolve(scope *Scope) (string, error) {
+    if _, err := e.target.resolve(scope); err != nil {
+        return "", err
+    }
+
+    if _, err := e.key.resolve(scope); err != nil {
+        return "", err
+    }
+
+    // The elements of lists and maps can have any type
+    return "", nil
+}
+
+func (e *indexExpr) String() string {
+    return e.target.String() + "[" + e.key.String() + "]"
+}
+
+
+type fieldExpr struct {
+    target exprNode
+    field string
+}
+
+func (e *fieldExpr) eval(scope Variables) (interface{}, error) {
+    value, err := e.target.eval(scope)
+    if err != nil {
+        return nil, err
+    }
+
+    return fieldValue(value, e.field)
+}
+
+func fieldValue(value interface{}, field string) (interface{}, error) {
+    accessible, ok := value.(Accessible)
+    if !ok {
+        return nil, fmt.Errorf("Value '%s' has no field '%s'", formatElement(value), field)
+    }
+
+    return accessible.Field(field)
+}
+
+func (e *fieldExpr) resolve(scope *Scope) (string, error) {
+    t, err := e.target.resolve(scope)
+    if err != nil || t == "" {
+        return "", err
+    }
+
+    st := scope.GetStructType(t)
+    if st == nil {
+        return "", errors.New(describeType(t) + " has no field " + e.field)
+    }
+
+    field := st.Field(e.field)
+    if field == nil {
+        return "", errors.New(st.Name + " has no field " + e.field)
+    }
+
+    return field.Type, nil
+}
+
+func (e *fieldExpr) String() string {
+    return e.target.String() + "." + e.field
+}
@@ -0,0 +1,201 @@
+package interpreter
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Frame is the activation record of a single function invocation. The scopes
+// declared inside of the function are instantiated per frame, so recursive
+// calls don't overwrite each others local variables.
+type Frame struct {
+    Function *FunctionDeclarationNode
+    Call *CallNode
+    // scopes holds the instances of the scopes of Function, indexed like them
+    scopes []*Scope
+    // locals and resume are used by the bytecode machine instead of scopes,
+    // resume is the instruction following the call
+    locals []interface{}
+    resume int
+    // parent is the invocation of the function Function is declared in, nil
+    // if it isn't declared inside of a function
+    parent *Frame
+}
+
+func NewFrame(call *CallNode, function *FunctionDeclarationNode) *Frame {
+    return &Frame{Function: function, Call: call, scopes: make([]*Scope, len(function.scopes))}
+}
+
+// pushFrame enters a function, linking its frame to the invocation of the
+// function it is declared in
+func (state *XiiState) pushFrame(frame *Frame) {
+    frame.parent = state.frameOf(frame.Function.GetScope().function)
+    state.FunctionStack.Push(frame)
+}
+
+// frameOf returns the invocation of function the innermost frame belongs to,
+// either the innermost frame itself or one of the functions enclosing it
+func (state *XiiState) frameOf(function *FunctionDeclarationNode) *Frame {
+    if function == nil || state.FunctionStack.Len() == 0 {
+        return nil
+    }
+
+    for frame := state.FunctionStack.Top(); frame != nil; frame = frame.parent {
+        if frame.Function == function {
+            return frame
+        }
+    }
+
+    return nil
+}
+
+// RuntimeScope returns the instance of a scope created by ParseTokens that
+// belongs to the current invocation. Code of a function only runs while its
+// invocation is the innermost one, or while a function declared inside of it
+// runs. Global scopes, and the scopes of functions that aren't running, are
+// returned unchanged.
+func (state *XiiState) RuntimeScope(scope *Scope) *Scope {
+    frame := state.frameOf(scope.function)
+    if frame == nil {
+        return scope
+    }
+
+    instance := frame.scopes[scope.index]
+    if instance == nil {
+        instance = scope.instantiate(state.RuntimeScope(scope.baseScope))
+        frame.scopes[scope.index] = instance
+    }
+
+    return instance
+}
+
+// ScopeOf returns the runtime scope a node executes in
+func (state *XiiState) ScopeOf(node INode) *Scope {
+    return state.RuntimeScope(node.GetScope())
+}
+
+// StackEntry is one line of the backtrace of a RuntimeError
+type StackEntry struct {
+    // Function is the name of the function executing, main for global code
+    Function string
+    Position Token
+}
+
+func (entry StackEntry) String() string {
+    return fmt.Sprintf("%s (%s:%d)", entry.Function, entry.Position.File, entry.Position.Line)
+}
+
+// RuntimeError is returned when a node fails while a script is running. It
+// wraps the original error together with the location it happened at.
+type RuntimeError struct {
+    Err error
+    // Trace is the trace of the failing node
+    Trace string
+    // Stack starts with the failing node, followed by the calls that led to it
+    Stack []StackEntry
+}
+
+func newRuntimeError(state *XiiState, node INode, err error) *RuntimeError {
+    stack := []StackEntry{{Function: functionName(node.GetScope().function), Position: node.GetPosition()}}
+
+    for i := 0; i < state.FunctionStack.Len(); i++ {
+        call := state.FunctionStack.Peek(i).Call
+        stack = append(stack, StackEntry{Function: functionName(call.GetScope().function), Position: call.GetPosition()})
+    }
+
+    return &RuntimeError{Err: err, Trace: node.GetTrace(), Stack: stack}
+}
+
+func functionName(function *FunctionDeclarationNode) string {
+    if function == nil {
+        return "main"
+    }
+
+    return function.Name
+}
+
+func (e *RuntimeError) Error() string {
+    return e.Err.Error() + "\n" + e.Backtrace()
+}
+
+func (e *RuntimeError) Unwrap() error {
+    return e.Err
+}
+
+// Backtrace formats the stack, e.g.
+//
+//  at add (math.xii:5)
+//  called from main (math.xii:20)
+func (e *RuntimeError) Backtrace() string {
+    lines := make([]string, len(e.Stack))
+    for i, entry := range e.Stack {
+        if i == 0 {
+            lines[i] = "    at " + entry.String()
+        } else {
+            lines[i] = "    called from " + entry.String()
+        }
+    }
+
+    return strings.Join(lines, "\n")
+}
+
+// recoverError looks for a try block around node, in the current function or
+// in one of its callers. If there is one, the frames above it are dropped,
+// the message is stored in the catch variable and execution continues in the
+// catch block.
+func (state *XiiState) recoverError(node INode, err error) bool {
+    try := state.unwindTo(node)
+    if try == nil {
+        return false
+    }
+
+    if try.Catch.Variable != "" {
+        state.RuntimeScope(try.Catch.BodyScope).SetVar(try.Catch.Variable, err.Error())
+    }
+
+    state.NextNode = try.Catch.Next()
+
+    return true
+}
+
+// unwindTo finds the try block handling an error at node and drops the frames
+// of the functions called inside of it. The stack is left as it is if there
+// is no handler.
+func (state *XiiState) unwindTo(node INode) *TryNode {
+    depth := 0
+    for {
+        try := enclosingTry(state.Nodes, node)
+        if try != nil {
+            for i := 0; i < depth; i++ {
+                state.FunctionStack.Pop()
+            }
+
+            return try
+        }
+
+        if depth == state.FunctionStack.Len() {
+            return nil
+        }
+
+        node = state.FunctionStack.Peek(depth).Call
+        depth++
+    }
+}
+
+// enclosingTry returns the innermost try block whose protected part contains
+// node. Nodes are stored in source order, so a block contains exactly the
+// nodes between its first and last node.
+func enclosingTry(nodes []INode, node INode) *TryNode {
+    function := node.GetScope().function
+
+    for i := node.GetID() - 1; i >= 0; i-- {
+        try, ok := nodes[i].(*TryNode)
+        if !ok || try.Catch.GetID() < node.GetID() || try.GetScope().function != function {
+            continue
+        }
+
+        return try
+    }
+
+    return nil
+}
@@ -1,69 +1,80 @@
 package interpreter
 
 import (
-    "log"
 	"fmt"
-	"os"
-	"bufio"
+    "context"
     "reflect"
     "time"
 )
 
-func Interpret(nodes []INode, state *XiiState, debug, trace, time bool) {
-    log.Println("Beginning interpretation...")
+func Interpret(ctx context.Context, nodes []INode, state *XiiState, debug, trace, time bool) error {
+    logger := orDiscardLogger(state.Logger)
+    logger.Println("Beginning interpretation...")
 
     if debug || trace || time {
-        log.Println("Using debug interpreter, expect performance penalties.")
-        InterpretDebug(nodes, state, debug, trace, time)
-    } else {
-        log.Println("Using release interpreter.")
-        InterpretRelease(nodes, state)
+        logger.Println("Using debug interpreter, expect performance penalties.")
+        return InterpretDebug(ctx, nodes, state, debug, trace, time)
     }
+
+    logger.Println("Using release interpreter.")
+    return InterpretRelease(ctx, nodes, state)
 }
 
-func InterpretRelease(nodes []INode, state *XiiState) {
-    for {
-        tmpNext := state.NextNode.GetID()
+func InterpretRelease(ctx context.Context, nodes []INode, state *XiiState) error {
+    done := ctx.Done()
 
-        err := state.NextNode.Execute(state)
-        
-        if err != nil {
-            fmt.Println("Error: " + err.Error())
-            break
+    for {
+        select {
+        case <-done:
+            return ctx.Err()
+        default:
         }
 
-        if state.NextNode != nil && tmpNext == state.NextNode.GetID() {
-            state.NextNode = state.NextNode.Next()
+        // Nodes that jump overwrite NextNode while executing
+        current := state.NextNode
+        state.NextNode = current.Next()
+
+        err := current.Execute(state)
+        
+        if err != nil && !state.recoverError(current, err) {
+            return newRuntimeError(state, current, err)
         }
 
         if state.NextNode == nil {
-            break
+            return nil
         }
     }
 }
 
-var ExecutionTimeTable map[string][]time.Duration
-
-func InterpretDebug(nodes []INode, state *XiiState, debug, trace, timeExec bool) {
+func InterpretDebug(ctx context.Context, nodes []INode, state *XiiState, debug, trace, timeExec bool) error {
     if debug {
-        fmt.Println("Debugging mode enabled, press enter after each command to continue.")
+        fmt.Fprintln(state.StdErr, "Debugging mode enabled, press enter after each command to continue.")
     }
 
-    log.Println("Initialized state, loop starting now!")
+    orDiscardLogger(state.Logger).Println("Initialized state, loop starting now!")
 
     if trace {
-        fmt.Println("Trace enabled")
+        fmt.Fprintln(state.StdErr, "Trace enabled")
     }
 
     if timeExec {
-        ExecutionTimeTable = make(map[string][]time.Duration)
+        state.ExecutionTimes = make(map[string][]time.Duration)
     }
 
+    done := ctx.Done()
+
     for {
-        tmpNext := state.NextNode.GetID()
+        select {
+        case <-done:
+            return ctx.Err()
+        default:
+        }
+
+        current := state.NextNode
+        state.NextNode = current.Next()
 
         if trace {
-            fmt.Printf("Trace :: ID: %d / %s / %s\n", tmpNext, state.NextNode.GetTrace(), reflect.TypeOf(state.NextNode))
+            fmt.Fprintf(state.StdErr, "Trace :: ID: %d / %s / %s\n", current.GetID(), current.GetTrace(), reflect.TypeOf(current))
         }
 
         var beforeTime time.Time
@@ -71,32 +82,26 @@ func InterpretDebug(nodes []INode, state *XiiState, debug, trace, timeExec bool)
             beforeTime = time.Now()
         }
 
-        err := state.NextNode.Execute(state)
+        err := current.Execute(state)
 
-        if timeExec && state.NextNode != nil {
+        if timeExec {
             duration := time.Since(beforeTime)
-            keyword := state.NextNode.GetTrace()
-            ExecutionTimeTable[keyword] = append(ExecutionTimeTable[keyword], duration)
+            keyword := current.GetTrace()
+            state.ExecutionTimes[keyword] = append(state.ExecutionTimes[keyword], duration)
         }
         
-        if err != nil {
-            fmt.Println("Error: " + err.Error())
-            break
-        }
-
-        if state.NextNode != nil && tmpNext == state.NextNode.GetID() {
-            state.NextNode = state.NextNode.Next()
+        if err != nil && !state.recoverError(current, err) {
+            return newRuntimeError(state, current, err)
         }
 
         if state.NextNode == nil {
-            break
+            return nil
         }
 
         if debug {
-            fmt.Println("Command done.")
-            reader := bufio.NewReader(os.Stdin)
-            _, _ = reader.ReadString('\n')
-            fmt.Println("Starting new command...")
+            fmt.Fprintln(state.StdErr, "Command done.")
+            _, _ = state.StdIn.ReadString('\n')
+            fmt.Fprintln(state.StdErr, "Starting new command...")
         }
     }
 }
@@ -1,243 +1,888 @@
 package interpreter
 
 import (
-    "strconv"
-    "strings"
     "errors"
     "log"
     "fmt"
 )
 
+// ParseTokens parses a script, imports are searched in the DefaultModulePath
 func ParseTokens(tokens [][]Token) ([]INode, error) {
-    log.Println("Lexing tokens...")
+    return parseTokens(tokens, NewScope(DummyScope), DefaultModulePath(), discardLogger)
+}
+
+// parseTokens parses tokens with global as the outermost scope, which already
+// holds the declarations of the code parsed before in interactive sessions.
+// Imports are searched in the directories of searchPath.
+func parseTokens(tokens [][]Token, global *Scope, searchPath []string, logger *log.Logger) ([]INode, error) {
+    logger.Println("Lexing tokens...")
+
+    imported, err := loadModules(tokens, searchPath, logger)
+    if err != nil {
+        return nil, err
+    }
 
-    nodes := make([]INode, len(tokens))
+    nodes := make([]INode, len(imported.tokens))
 
     scopeStack := NewScopeStack()
-    scopeStack.Push(NewScope(DummyScope))
-    
-    for ii, line := range tokens {
-        var newNode INode
+    scopeStack.Push(global)
+
+    // The module the current line belongs to, nil for the script itself
+    var current *module
+
+    // Holds the nodes that opened the blocks we are currently in
+    blockStack := NewNodeStack()
+
+    // Problems are collected, so that all of them can be reported at once
+    var diagnostics Diagnostics
+
+    // Block openers that fail to parse are replaced by placeholders, so the
+    // lines following them keep their blocks and scopes. Those lines are
+    // marked as broken, they are left out when checking the rest.
+    placeholders := make(map[INode]bool)
+    broken := make([]bool, len(imported.tokens))
+    var lastKeyword Token
+    depth := 0
+
+    // Blocks reported as never closed aren't initialized, they would only
+    // report their missing end again. branches maps else and catch nodes to
+    // the node of the branch they follow.
+    unclosed := make(map[INode]bool)
+    branches := make(map[INode]INode)
+    reportUnclosed := func() {
+        for blockStack.Len() > 0 {
+            node := blockStack.Pop()
+            diagnostics.add(node.GetPosition(), "Block is never closed, missing end")
+            for ; node != nil; node = branches[node] {
+                unclosed[node] = true
+            }
+        }
+    }
 
-        keyword := line[0]
-        var parameter []IParameter
+lines:
+    for ii, line := range imported.tokens {
+        var newNode INode
 
-        trace := fmt.Sprintf("File: %s / Line: %d / %s", line[0].File, line[0].Line, keyword.Text)
-
-        var lastP IParameter
-        var addedLit bool
-        for _, p := range line[1:] {
-            _, err := strconv.ParseFloat(p.Text, 64)
-            if err == nil {
-                lastP = &NumberParameter{Parameter: Parameter{Text: p.Text}}
-                parameter = append(parameter, lastP)
-                continue
-            }
-
-            lp, isLit := lastP.(*LiteralParameter)
-            if (!addedLit && isLit && strings.Index(parameter[len(parameter)-1].GetRaw(), "\"") < 1 && parameter[len(parameter)-1].GetRaw() != "\"") ||
-                (addedLit && strings.Count(parameter[len(parameter)-1].GetRaw(), "\"") != 2) ||
-                strings.Index(p.Text, "\"") == 0 {
-                if isLit {
-                    lp.Text += " " + p.Text
-                    addedLit = true
-                } else {
-                    lastP = &LiteralParameter{Parameter: Parameter{Text: p.Text}}
-                    parameter = append(parameter, lastP)
-                    addedLit = false
-                }
-                continue
+        if ii > 0 && nodes[ii - 1] == nil {
+            if blockStack.Len() > depth {
+                // The block was opened before the problem was found
+                placeholders[blockStack.Top()] = true
+            } else if placeholder := placeholderBlock(lastKeyword, ii - 1, scopeStack.Top()); placeholder != nil {
+                placeholders[placeholder] = true
+                scopeStack.Push(NewScope(scopeStack.Top()))
+                blockStack.Push(placeholder)
             }
+        }
 
-            addedLit = false
+        if owner := imported.modules[ii]; owner != current {
+            // Modules are parsed in their own top level scope, they start and
+            // end outside of any blocks
+            reportUnclosed()
 
-            if isOperator(p.Text) {
-                lastP = &OperatorParameter{Parameter: Parameter{Text: p.Text}}
-                parameter = append(parameter, lastP)
+            scopeStack = NewScopeStack()
+            if owner == nil {
+                scopeStack.Push(global)
             } else {
-                lastP = &VariableParameter{Parameter: Parameter{Text: p.Text}}
-                parameter = append(parameter, lastP)
+                scopeStack.Push(owner.scope)
+            }
+            current = owner
+        }
+
+        depth = blockStack.Len()
+        for i := 0; i < blockStack.Len(); i++ {
+            if placeholders[blockStack.Peek(i)] {
+                broken[ii] = true
+            }
+        }
+
+        words := groupWords(line)
+        keyword := joinWords(words[0])
+        var parameter []IParameter
+        lastKeyword = keyword
+
+        trace := fmt.Sprintf("File: %s / Line: %d / %s", keyword.File, keyword.Line, keyword.Text)
+
+        for _, word := range words[1:] {
+            p, err := newParameter(word)
+            if err != nil {
+                diagnostics.addError(joinWords(word), err)
+                continue lines
             }
+            parameter = append(parameter, p)
         }
 
-        if keyword.Text == "end" {
+        if def := enclosingStruct(blockStack); def != nil && keyword.Text != "end" {
+            // Every line of a struct block declares a field as "<type> <name>"
+            if len(parameter) != 1 {
+                diagnostics.add(keyword, "Invalid field syntax, expected <type> <name>")
+                continue lines
+            }
+
+            field := StructField{Name: parameter[0].GetRaw(), Type: keyword.Text, Struct: scopeStack.Top().GetStructType(keyword.Text)}
+
+            if !scopeStack.Top().isType(field.Type) {
+                diagnostics.add(keyword, "Unknown type " + field.Type + " for field " + field.Name)
+                continue lines
+            }
+
+            if field.Struct == def.Type {
+                diagnostics.add(keyword, "Struct " + def.Type.Name + " can't contain itself")
+                continue lines
+            }
+
+            if def.Type.Field(field.Name) != nil {
+                diagnostics.add(keyword, "Field " + field.Name + " is declared twice")
+                continue lines
+            }
+
+            def.Type.Fields = append(def.Type.Fields, field)
+
+            newNode = &FieldDefinitionNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
+        } else if keyword.Text == "end" {
+            if blockStack.Len() == 0 {
+                // After an error, a block opener might be missing
+                if len(diagnostics) == 0 {
+                    diagnostics.add(keyword, "end without matching block")
+                }
+                continue lines
+            }
+
+            if _, isTry := blockStack.Top().(*TryNode); isTry {
+                diagnostics.add(keyword, "try without catch")
+            }
+
             newNode = &BlockEndNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
             scopeStack.Pop()
+            blockStack.Pop()
         } else if keyword.Text == "while" {
             newNode = &LoopNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
             scopeStack.Push(NewScope(scopeStack.Top()))
+            blockStack.Push(newNode)
+        } else if keyword.Text == "for" {
+            if len(parameter) < 1 {
+                diagnostics.add(keyword, "A for loop needs a loop variable")
+                continue lines
+            }
+
+            loop := &ForNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}, Variable: parameter[0].GetRaw()}
+            newNode = loop
+
+            loop.BodyScope = NewScope(scopeStack.Top())
+            loop.BodyScope.declare(loop.Variable, zeroValue("number"))
+            loop.BodyScope.declare(forLimitVariable, nil)
+            loop.BodyScope.declare(forStepVariable, nil)
+            scopeStack.Push(loop.BodyScope)
+            blockStack.Push(newNode)
+        } else if keyword.Text == "foreach" {
+            if len(parameter) < 3 || parameter[1].GetRaw() != "in" {
+                diagnostics.add(keyword, "Invalid foreach syntax, expected foreach <var> in <list or map>")
+                continue lines
+            }
+
+            loop := &ForEachNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}, Variable: parameter[0].GetRaw()}
+            newNode = loop
+
+            loop.BodyScope = NewScope(scopeStack.Top())
+            loop.BodyScope.declare(loop.Variable, zeroValue("number"))
+            loop.BodyScope.declare(forEachItemsVariable, nil)
+            loop.BodyScope.declare(forEachIndexVariable, nil)
+            loop.BodyScope.untyped = map[string]bool{loop.Variable: true}
+            scopeStack.Push(loop.BodyScope)
+            blockStack.Push(newNode)
         } else if keyword.Text == "if" {
             newNode = &ConditionNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
             scopeStack.Push(NewScope(scopeStack.Top()))
+            blockStack.Push(newNode)
+        } else if keyword.Text == "else" || keyword.Text == "elseif" {
+            var previous INode
+            if blockStack.Len() > 0 {
+                previous = blockStack.Top()
+            }
+
+            _, isCondition := previous.(*ConditionNode)
+            previousElse, isElse := previous.(*ElseNode)
+
+            if !isCondition && !isElse {
+                diagnostics.add(keyword, keyword.Text + " without matching if")
+                continue lines
+            }
+
+            if isElse && previousElse.Keyword == "else" {
+                diagnostics.add(keyword, keyword.Text + " can't follow an else branch")
+                continue lines
+            }
+
+            if keyword.Text == "else" && len(parameter) > 0 {
+                diagnostics.add(keyword, "else doesn't take a condition, use elseif")
+                continue lines
+            }
+
+            if keyword.Text == "elseif" && len(parameter) == 0 {
+                diagnostics.add(keyword, "elseif requires a condition")
+                continue lines
+            }
+
+            scopeStack.Pop()
+            blockStack.Pop()
+
+            newNode = &ElseNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
+            scopeStack.Push(NewScope(scopeStack.Top()))
+            blockStack.Push(newNode)
+            branches[newNode] = previous
+            if placeholders[previous] {
+                placeholders[newNode] = true
+            }
+        } else if keyword.Text == "try" {
+            if len(parameter) > 0 {
+                diagnostics.add(keyword, "try doesn't take any parameters")
+                continue lines
+            }
+
+            newNode = &TryNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
+            scopeStack.Push(NewScope(scopeStack.Top()))
+            blockStack.Push(newNode)
+        } else if keyword.Text == "catch" {
+            var try *TryNode
+            if blockStack.Len() > 0 {
+                try, _ = blockStack.Top().(*TryNode)
+            }
+
+            if try == nil {
+                diagnostics.add(keyword, "catch without matching try")
+                continue lines
+            }
+
+            if len(parameter) > 1 {
+                diagnostics.add(keyword, "Invalid catch syntax, expected catch [<varname>]")
+                continue lines
+            }
+
+            scopeStack.Pop()
+            blockStack.Pop()
+
+            catch := &CatchNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
+            newNode = catch
+            try.Catch = catch
+            if placeholders[try] {
+                placeholders[newNode] = true
+            }
+
+            catch.BodyScope = NewScope(scopeStack.Top())
+            if len(parameter) == 1 {
+                catch.Variable = parameter[0].GetRaw()
+                catch.BodyScope.declare(catch.Variable, zeroValue("string"))
+            }
+            scopeStack.Push(catch.BodyScope)
+            blockStack.Push(newNode)
+            branches[newNode] = try
+        } else if keyword.Text == "throw" {
+            if len(parameter) == 0 {
+                diagnostics.add(keyword, "throw needs a message")
+                continue lines
+            }
+
+            newNode = &ThrowNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
+        } else if keyword.Text == "break" || keyword.Text == "continue" {
+            loop := enclosingLoop(blockStack)
+
+            if loop == nil {
+                diagnostics.add(keyword, keyword.Text + " is only allowed inside of loops")
+                continue lines
+            }
+
+            if len(parameter) > 0 {
+                diagnostics.add(keyword, keyword.Text + " doesn't take any parameters")
+                continue lines
+            }
+
+            if keyword.Text == "break" {
+                newNode = &BreakNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}, Loop: loop}
+            } else {
+                newNode = &ContinueNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}, Loop: loop}
+            }
         } else if keyword.Text == "number" {
             newNode = &NumberDeclarationNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
             if len(parameter) != 1 {
-                return nil, errors.New(trace + ": Invalid number syntax")
+                diagnostics.add(keyword, "Invalid number syntax")
+                continue lines
+            }
+            if err := scopeStack.Top().declare(parameter[0].GetRaw(), zeroValue(keyword.Text)); err != nil {
+                diagnostics.addError(keyword, err)
+                continue lines
             }
-            scopeStack.Top().variableTable[parameter[0].GetRaw()] = float64(0)
         } else if keyword.Text == "string" {
             newNode = &LiteralDeclarationNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
             if len(parameter) != 1 {
-                return nil, errors.New(trace + ": Invalid string syntax")
+                diagnostics.add(keyword, "Invalid string syntax")
+                continue lines
+            }
+            if err := scopeStack.Top().declare(parameter[0].GetRaw(), zeroValue(keyword.Text)); err != nil {
+                diagnostics.addError(keyword, err)
+                continue lines
+            }
+        } else if keyword.Text == "int" {
+            newNode = &IntDeclarationNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
+            if len(parameter) != 1 {
+                diagnostics.add(keyword, "Invalid int syntax")
+                continue lines
+            }
+            if err := scopeStack.Top().declare(parameter[0].GetRaw(), zeroValue(keyword.Text)); err != nil {
+                diagnostics.addError(keyword, err)
+                continue lines
+            }
+        } else if keyword.Text == "bool" {
+            newNode = &BoolDeclarationNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
+            if len(parameter) != 1 {
+                diagnostics.add(keyword, "Invalid bool syntax")
+                continue lines
+            }
+            if err := scopeStack.Top().declare(parameter[0].GetRaw(), zeroValue(keyword.Text)); err != nil {
+                diagnostics.addError(keyword, err)
+                continue lines
+            }
+        } else if keyword.Text == "list" {
+            newNode = &ListDeclarationNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
+            if len(parameter) != 1 {
+                diagnostics.add(keyword, "Invalid list syntax")
+                continue lines
+            }
+            if err := scopeStack.Top().declare(parameter[0].GetRaw(), zeroValue(keyword.Text)); err != nil {
+                diagnostics.addError(keyword, err)
+                continue lines
+            }
+        } else if keyword.Text == "map" {
+            newNode = &MapDeclarationNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
+            if len(parameter) != 1 {
+                diagnostics.add(keyword, "Invalid map syntax")
+                continue lines
+            }
+            if err := scopeStack.Top().declare(parameter[0].GetRaw(), zeroValue(keyword.Text)); err != nil {
+                diagnostics.addError(keyword, err)
+                continue lines
             }
-            scopeStack.Top().variableTable[parameter[0].GetRaw()] = ""
+        } else if keyword.Text == "struct" {
+            if len(parameter) != 1 {
+                diagnostics.add(keyword, "Invalid struct syntax, expected struct <name>")
+                continue lines
+            }
+
+            name := parameter[0].GetRaw()
+            if scopeStack.Top().isType(name) {
+                diagnostics.add(keyword, "Type " + name + " is already declared")
+                continue lines
+            }
+
+            def := &StructDefinitionNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}, Type: &StructType{Name: name}}
+            newNode = def
+
+            scopeStack.Top().structTable[name] = def.Type
+            scopeStack.Push(NewScope(scopeStack.Top()))
+            blockStack.Push(newNode)
+        } else if st := scopeStack.Top().GetStructType(keyword.Text); st != nil {
+            newNode = &StructDeclarationNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
+            if len(parameter) != 1 {
+                diagnostics.add(keyword, "Invalid " + st.Name + " syntax")
+                continue lines
+            }
+            if err := scopeStack.Top().declare(parameter[0].GetRaw(), st.New()); err != nil {
+                diagnostics.addError(keyword, err)
+                continue lines
+            }
+        } else if keyword.Text == "delete" {
+            if len(parameter) < 2 {
+                diagnostics.add(keyword, "Invalid delete syntax, expected delete <map> <key>")
+                continue lines
+            }
+            newNode = &DeleteNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
+        } else if keyword.Text == "append" {
+            if len(parameter) < 2 {
+                diagnostics.add(keyword, "Invalid append syntax, expected append <list> <value>")
+                continue lines
+            }
+            newNode = &AppendNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
         } else if keyword.Text == "out" {
             newNode = &OutputNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
         } else if keyword.Text == "in" {
             newNode = &InputNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
         } else if keyword.Text == "function" {
             if len(parameter) < 1 {
-                return nil, errors.New(trace + ": A function declaration needs at least a name as a first parameter")
+                diagnostics.add(keyword, "A function declaration needs at least a name as a first parameter")
+                continue lines
+            }
+
+            // A function with a return value is declared as "function <type> <var> <name> ..."
+            signature := parameter
+            var result Passer
+            if len(signature) >= 3 && scopeStack.Top().isType(signature[0].GetRaw()) {
+                result = Passer{Type: signature[0].GetRaw(), Name: signature[1].GetRaw()}
+                signature = signature[2:]
+            }
+
+            if len(signature) % 2 != 1 {
+                diagnostics.add(keyword, "Function parameters have to be given as pairs of type and name")
+                continue lines
             }
 
-            passers := make([]Passer, (len(parameter) - 1) / 2)
+            passers := make([]Passer, (len(signature) - 1) / 2)
 
             counter := 0
-            for i := 1; i < len(parameter); i+=2 {
-                passers[counter] = Passer{Type: parameter[i].GetRaw(), Name: parameter[i + 1].GetRaw()}
+            for i := 1; i < len(signature); i+=2 {
+                passers[counter] = Passer{Type: signature[i].GetRaw(), Name: signature[i + 1].GetRaw()}
                 counter++
             }
 
-            newNode = &FunctionDeclarationNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}, Parameters: passers}
+            fn := &FunctionDeclarationNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}, Name: signature[0].GetRaw(), Parameters: passers, Result: result}
+            newNode = fn
 
-            scopeStack.Top().functionTable[parameter[0].GetRaw()] = newNode
+            scopeStack.Top().functionTable[fn.Name] = newNode
 
-            scopeStack.Push(NewScope(scopeStack.Top()))
+            fn.BodyScope = newScope(scopeStack.Top(), fn)
+            scopeStack.Push(fn.BodyScope)
+            blockStack.Push(newNode)
+
+            for _, passer := range append(passers, result) {
+                if passer.Name == "" {
+                    continue
+                }
+
+                if !scopeStack.Top().isType(passer.Type) {
+                    diagnostics.add(keyword, "Unknown type " + passer.Type + " for " + passer.Name)
+                    continue lines
+                }
+
+                if err := scopeStack.Top().declare(passer.Name, scopeStack.Top().zeroValue(passer.Type)); err != nil {
+                    diagnostics.addError(keyword, err)
+                    continue lines
+                }
+            }
+        } else if keyword.Text == "return" {
+            fn := enclosingFunction(blockStack)
+
+            if fn == nil {
+                diagnostics.add(keyword, "return is only allowed inside of functions")
+                continue lines
+            }
+
+            if len(parameter) > 0 && fn.Result.Name == "" {
+                diagnostics.add(keyword, "Function " + fn.Name + " has no return type, can't return a value")
+                continue lines
+            }
+
+            newNode = &ReturnNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}, Function: fn}
+        } else if keyword.Text == "import" {
+            if blockStack.Len() > 0 {
+                diagnostics.add(keyword, "import is only allowed outside of blocks")
+                continue lines
+            }
+
+            _, alias, err := parseImport(line)
+            if err != nil {
+                diagnostics.add(keyword, err.Error())
+                continue lines
+            }
+
+            if scopeStack.Top().modules[alias] != nil {
+                diagnostics.add(keyword, "A module is already imported as " + alias)
+                continue lines
+            }
+
+            m := imported.imports[ii]
+            scopeStack.Top().modules[alias] = m.scope
+
+            newNode = &ImportNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}, Module: m.path}
         } else if keyword.Text == "call" {
             if len(parameter) < 1 {
-                return nil, errors.New(trace + ": A function call needs a function name as a first parameter")
+                diagnostics.add(keyword, "A function call needs a function name as a first parameter")
+                continue lines
             }
 
             funcNode := scopeStack.Top().GetFunctionNode(parameter[0].GetRaw())
 
             if funcNode == nil {
-                return nil, errors.New(trace + ": Tried to call invalid function")
+                diagnostics.add(keyword, "Tried to call invalid function")
+                continue lines
             }
 
             fn := funcNode.(*FunctionDeclarationNode)
 
-            if len(fn.Parameters) != len(parameter) - 1 {
-                return nil, errors.New(trace + ": Parameter mismatch")
+            // The name isn't evaluated, m.output would access a field of m otherwise
+            parameter[0] = &VariableParameter{Parameter: Parameter{Text: parameter[0].GetRaw(), tokens: words[1]}}
+
+            // "call <name> [parameter]* -> <var>" stores the result in var
+            arguments := parameter[1:]
+            var target string
+            if len(arguments) >= 2 && arguments[len(arguments) - 2].GetRaw() == "->" {
+                target = arguments[len(arguments) - 1].GetRaw()
+                arguments = arguments[:len(arguments) - 2]
+
+                if fn.Result.Name == "" {
+                    diagnostics.add(keyword, "Function " + fn.Name + " does not return a value")
+                    continue lines
+                }
+
+                if scopeStack.Top().GetVar(target) == nil {
+                    diagnostics.add(keyword, "Can't store result in undeclared variable " + target)
+                    continue lines
+                }
+            }
+
+            if len(fn.Parameters) != len(arguments) {
+                diagnostics.add(keyword, "Parameter mismatch")
+                continue lines
             }
 
             passers := make(map[string]IParameter)
 
-            for i := 1; i < len(parameter); i++ {
-                passers[fn.Parameters[i - 1].Name] = parameter[i]
+            for i, argument := range arguments {
+                passers[fn.Parameters[i].Name] = argument
             }
 
-            newNode = &CallNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}, Passers: passers}
+            newNode = &CallNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}, Passers: passers, Target: target}
         } else {
-            isVar := scopeStack.Top().GetVar(keyword.Text)
+            // Everything in front of the "=" is the target, e.g. x, xs[i + 1] or p.x
+            targetTokens := words[0]
+            assignment := 0
+            for assignment < len(parameter) && parameter[assignment].GetRaw() != "=" {
+                targetTokens = append(targetTokens, words[assignment + 1]...)
+                assignment++
+            }
+            target := joinWords(targetTokens).Text
+
+            name, path, err := parseTargetPath(targetTokens)
+            if err != nil {
+                diagnostics.addError(keyword, err)
+                continue lines
+            }
+
+            isVar := scopeStack.Top().GetVar(name)
 
             if isVar != nil {
-                newNode = &SetNode{Node: Node{Keyword: keyword.Text, Parameter: parameter, ID: ii, Trace: trace, Scope: scopeStack.Top()}}
+                if assignment < len(parameter) {
+                    err = checkFieldTarget(isVar, path, parameter[assignment + 1:])
+                    if err != nil {
+                        diagnostics.add(keyword, err.Error())
+                        continue lines
+                    }
+                }
+
+                newNode = &SetNode{Node: Node{Keyword: name, Parameter: parameter[assignment:], ID: ii, Trace: trace, Scope: scopeStack.Top()}, Target: target, path: path}
             }
         }
 
-        if ii > 0 {
-            calcPrevNext(ii, nodes, newNode)
+        if newNode == nil {
+            diagnostics.add(keyword, "Node type " + keyword.Text + " unknown, maybe a keyword is wrong? Also check variable declarations/scopes.")
+            continue lines
         }
 
-        if newNode == nil {
-            return nil, errors.New(trace + ": Node type " + keyword.Text + " unknown, maybe a keyword is wrong? Also check variable declarations/scopes.")
+        newNode.(positionedNode).setPosition(keyword)
+
+        // Nodes can't be linked once one of them is missing
+        if ii > 0 && len(diagnostics) == 0 {
+            calcPrevNext(ii, nodes, newNode)
         }
 
         nodes[ii] = newNode
     }
 
-    // Ugly hack
-    if len(nodes) > 1 {
-        lastNode := nodes[len(nodes) - 1]
-        if lastNode.GetKeyword() == "end" {
-            val := lastNode.(*BlockEndNode)
-            val.PreviousNode = nodes[len(nodes) - 2]
+    reportUnclosed()
+
+    if len(diagnostics) > 0 {
+        // The nodes that did parse are still checked, so all problems are
+        // reported at once
+        var parsed []INode
+        for ii, node := range nodes {
+            if node != nil && !broken[ii] {
+                parsed = append(parsed, node)
+            }
+        }
+
+        nodes = parsed
+        for i := range nodes {
+            if i > 0 {
+                calcPrevNext(i, nodes, nodes[i])
+            }
         }
     }
 
-    log.Println("Initializing nodes...")
+    // The last node never gets linked by calcPrevNext
+    if len(nodes) > 1 {
+        nodes[len(nodes) - 1].(linkedNode).setLinks(nodes[len(nodes) - 2], nil)
+    }
+
+    logger.Println("Initializing nodes...")
 
     for _, node := range nodes {
-        err := node.Init(nodes)
+        if unclosed[node] {
+            continue
+        }
+
+        err := resolveParameters(node)
+        if err == nil {
+            err = node.Init(nodes)
+        }
         if err != nil {
-            log.Println(node.GetTrace() + ": " + err.Error())
-            return nil, errors.New("Error while initializing")
+            diagnostics.addError(node.GetPosition(), err)
+        }
+    }
+
+    if len(diagnostics) > 0 {
+        // The type errors of the other nodes are reported along with them
+        if typeErrors, ok := CheckTypes(nodes).(Diagnostics); ok {
+            diagnostics = append(diagnostics, typeErrors...)
         }
+        diagnostics.sort()
+
+        return nil, diagnostics
     }
 
-    log.Printf("Tokens processed, %d nodes created. Program ready for execution.\n", len(nodes))
+    logger.Printf("Tokens processed, %d nodes created. Program ready for execution.\n", len(nodes))
 
     return nodes, nil
 }
 
-func isOperator(t string) bool {
-    return t == "==" || t == "=" || t == "!=" ||
-        t == "<" || t == ">" || t == "<=" || t == ">=" ||
-        t == "+" || t == "-" || t == "/" || t == "*" || t == "%" ||
-        t == "(" || t == ")"
+// resolveParameters resolves the variables used by parameters, which can
+// only be done once all variables are declared
+func resolveParameters(node INode) error {
+    for _, p := range node.(parameterizedNode).parameters() {
+        r, ok := p.(resolvableParameter)
+        if !ok {
+            continue
+        }
+
+        err := r.resolve(node.GetScope())
+        if err != nil {
+            return prefixError("Invalid parameter " + p.GetRaw() + ": ", err)
+        }
+    }
+
+    return nil
 }
 
-func calcPrevNext(ii int, nodes []INode, newNode INode) {
-    switch nodes[ii - 1].GetKeyword() {
-    case "end":
-        val := nodes[ii - 1].(*BlockEndNode)
-        val.NextNode = newNode
-        if ii > 1 {
-            val.PreviousNode = nodes[ii - 2]
+// groupWords splits the tokens of a line into words, the parts separated by
+// whitespace. Brackets group everything up to the closing bracket into one
+// word, so xs[i + 1] and f(a, b) are single parameters.
+func groupWords(line []Token) [][]Token {
+    var words [][]Token
+
+    depth := 0
+    for i, token := range line {
+        if depth > 0 || (i > 0 && adjacent(line[i - 1], token)) {
+            words[len(words) - 1] = append(words[len(words) - 1], token)
+        } else {
+            words = append(words, []Token{token})
         }
-    case "while":
-        val := nodes[ii - 1].(*LoopNode)
-        val.NextNode = newNode
-        if ii > 1 {
-            val.PreviousNode = nodes[ii - 2]
+
+        if token.Kind != TokenOperator {
+            continue
         }
-    case "if":
-        val := nodes[ii - 1].(*ConditionNode)
-        val.NextNode = newNode
-        if ii > 1 {
-            val.PreviousNode = nodes[ii - 2]
-        }
-    case "number":
-        val := nodes[ii - 1].(*NumberDeclarationNode)
-        val.NextNode = newNode
-        if ii > 1 {
-            val.PreviousNode = nodes[ii - 2]
-        }
-    case "string":
-        val := nodes[ii - 1].(*LiteralDeclarationNode)
-        val.NextNode = newNode
-        if ii > 1 {
-            val.PreviousNode = nodes[ii - 2]
-        }
-    case "out":
-        val := nodes[ii - 1].(*OutputNode)
-        val.NextNode = newNode
-        if ii > 1 {
-            val.PreviousNode = nodes[ii - 2]
-        }
-    case "in":
-        val := nodes[ii - 1].(*InputNode)
-        val.NextNode = newNode
-        if ii > 1 {
-            val.PreviousNode = nodes[ii - 2]
+
+        switch token.Text {
+        case "(", "[":
+            depth++
+        case ")", "]":
+            if depth > 0 {
+                depth--
+            }
+        }
+    }
+
+    return words
+}
+
+// joinWords merges the tokens of a word into one token, which starts where
+// the word starts and has the source of the whole word as its text
+func joinWords(word []Token) Token {
+    joined := word[0]
+    for i := 1; i < len(word); i++ {
+        if !adjacent(word[i - 1], word[i]) {
+            joined.Text += " "
+        }
+        joined.Text += word[i].Text
+    }
+
+    return joined
+}
+
+// newParameter creates the parameter for a word. Words made of several
+// tokens, like xs[i] or n-1, are expressions.
+func newParameter(word []Token) (IParameter, error) {
+    if len(word) > 1 {
+        exp, err := newExpressionParameter(word)
+        if err != nil {
+            return nil, prefixError("Invalid parameter " + joinWords(word).Text + ": ", err)
         }
+        return exp, nil
+    }
+
+    token := word[0]
+    p := Parameter{Text: token.Text, tokens: word}
+    switch token.Kind {
+    case TokenString:
+        return &LiteralParameter{Parameter: p, value: token.Value}, nil
+    case TokenNumber:
+        return &NumberParameter{Parameter: p}, nil
+    case TokenOperator:
+        return &OperatorParameter{Parameter: p}, nil
+    }
+
+    switch token.Text {
+    case "true", "false":
+        return &BoolParameter{Parameter: p}, nil
+    case "and", "or", "not", "xor":
+        return &OperatorParameter{Parameter: p}, nil
+    }
+
+    return &VariableParameter{Parameter: p}, nil
+}
+
+// placeholderBlock returns the block opened by the statement starting with
+// keyword, nil if it doesn't open one. It stands in for the node of a block
+// opener that failed to parse.
+func placeholderBlock(keyword Token, id int, scope *Scope) INode {
+    node := Node{Keyword: keyword.Text, ID: id, Scope: scope}
+
+    var block INode
+    switch keyword.Text {
+    case "if":
+        block = &ConditionNode{Node: node}
+    case "while":
+        block = &LoopNode{Node: node}
+    case "for":
+        block = &ForNode{Node: node}
+    case "foreach":
+        block = &ForEachNode{Node: node}
     case "function":
-        val := nodes[ii - 1].(*FunctionDeclarationNode)
-        val.NextNode = newNode
-        if ii > 1 {
-            val.PreviousNode = nodes[ii - 2]
+        block = &FunctionDeclarationNode{Node: node}
+    case "struct":
+        block = &StructDefinitionNode{Node: node, Type: &StructType{}}
+    case "try":
+        block = &TryNode{Node: node}
+    default:
+        return nil
+    }
+
+    block.(positionedNode).setPosition(keyword)
+
+    return block
+}
+
+func enclosingFunction(blockStack *NodeStack) *FunctionDeclarationNode {
+    for i := 0; i < blockStack.Len(); i++ {
+        fn, ok := blockStack.Peek(i).(*FunctionDeclarationNode)
+        if ok {
+            return fn
+        }
+    }
+
+    return nil
+}
+
+// enclosingStruct returns the struct whose fields are currently being declared
+func enclosingStruct(blockStack *NodeStack) *StructDefinitionNode {
+    if blockStack.Len() == 0 {
+        return nil
+    }
+
+    def, _ := blockStack.Top().(*StructDefinitionNode)
+
+    return def
+}
+
+// checkFieldTarget makes sure the fields assigned to exist and, for single
+// literal values, that their types match. Values behind indices are not known
+// before runtime, so checking stops at the first index.
+func checkFieldTarget(variable interface{}, path []pathElement, value []IParameter) error {
+    current := variable
+    for _, element := range path {
+        if element.index != nil {
+            return nil
         }
-    case "call":
-        val := nodes[ii - 1].(*CallNode)
-        val.NextNode = newNode
-        if ii > 1 {
-            val.PreviousNode = nodes[ii - 2]
+
+        s, ok := current.(*Struct)
+        if !ok {
+            return errors.New(typeOf(current) + " has no field " + element.field)
+        }
+
+        field := s.Type.Field(element.field)
+        if field == nil {
+            return errors.New(s.Type.Name + " has no field " + element.field)
         }
+
+        current = s.Fields[field.Name]
+    }
+
+    if len(path) == 0 || len(value) != 1 {
+        return nil
+    }
+
+    var valueType string
+    switch value[0].(type) {
+    case *NumberParameter:
+        valueType = "number"
+        if _, err := convertValue(value[0].GetValue(nil), typeOf(current)); err != nil {
+            return err
+        }
+        if typeOf(current) == "int" {
+            valueType = "int"
+        }
+    case *LiteralParameter:
+        valueType = "string"
+    case *BoolParameter:
+        valueType = "bool"
     default:
-        val := nodes[ii - 1].(*SetNode)
-        val.NextNode = newNode
-        if ii > 1 {
-            val.PreviousNode = nodes[ii - 2]
+        return nil
+    }
+
+    if valueType != typeOf(current) {
+        return errors.New("Can't assign " + valueType + " to " + typeOf(current) + " field " + path[len(path) - 1].field)
+    }
+
+    return nil
+}
+
+// enclosingLoop returns the innermost loop of the current function or global code
+func enclosingLoop(blockStack *NodeStack) ILoopNode {
+    for i := 0; i < blockStack.Len(); i++ {
+        switch block := blockStack.Peek(i).(type) {
+        case ILoopNode:
+            return block
+        case *FunctionDeclarationNode:
+            return nil
         }
     }
-}
\ No newline at end of file
+
+    return nil
+}
+
+type positionedNode interface {
+    setPosition(token Token)
+}
+
+type parameterizedNode interface {
+    parameters() []IParameter
+}
+
+type resolvableParameter interface {
+    resolve(scope *Scope) error
+}
+
+type tokenizedParameter interface {
+    sourceTokens() []Token
+}
+
+type linkedNode interface {
+    setLinks(previous, next INode)
+}
+
+type numberedNode interface {
+    setID(id int)
+}
+
+func calcPrevNext(ii int, nodes []INode, newNode INode) {
+    var previous INode
+    if ii > 1 {
+        previous = nodes[ii - 2]
+    }
+
+    nodes[ii - 1].(linkedNode).setLinks(previous, newNode)
+}
@@ -0,0 +1,533 @@
+package interpreter
+
+import (
+    "context"
+    "errors"
+    "io"
+)
+
+// machine holds the state of a running Program, the calls are tracked on the
+// FunctionStack of the XiiState like in the tree walker
+type machine struct {
+    program *Program
+    state *XiiState
+    globals []interface{}
+    // function and locals cache the innermost frame
+    function *FunctionDeclarationNode
+    locals []interface{}
+    // scopes give the statements executed by OpRun access to the slots by name
+    scopes []slotScope
+}
+
+// slotScope implements Variables on top of the slots of a machine
+type slotScope struct {
+    machine *machine
+    programScope
+}
+
+func (scope *slotScope) GetVar(name string) interface{} {
+    at, ok := scope.scope.resolveSlot(name)
+    if !ok {
+        return nil
+    }
+
+    return scope.load(at)
+}
+
+func (scope *slotScope) SetVar(name string, value interface{}) {
+    if at, ok := scope.scope.resolveSlot(name); ok {
+        scope.store(at, value)
+    }
+}
+
+func (scope *slotScope) load(at variableSlot) interface{} {
+    return scope.machine.load(scope.slot(at))
+}
+
+func (scope *slotScope) store(at variableSlot, value interface{}) {
+    scope.machine.store(scope.slot(at), value)
+}
+
+// Execute runs a compiled program. It behaves exactly like InterpretRelease
+// running the nodes the program was compiled from.
+func Execute(ctx context.Context, program *Program, state *XiiState) error {
+    orDiscardLogger(state.Logger).Println("Using bytecode machine.")
+
+    m := &machine{program: program, state: state}
+
+    // Every run starts with fresh globals, lists and maps aren't shared with
+    // previous runs of the program
+    m.globals = make([]interface{}, len(program.globals))
+    for i, v := range program.globals {
+        m.globals[i] = freshValue(v)
+    }
+
+    m.scopes = make([]slotScope, len(program.scopes))
+    for i, scope := range program.scopes {
+        m.scopes[i] = slotScope{machine: m, programScope: scope}
+    }
+
+    code := program.Code
+    done := ctx.Done()
+    stack := make([]interface{}, 0, 16)
+    pc := 0
+
+    for steps := 0; pc < len(code); steps++ {
+        // Checking for cancellation is expensive compared to most instructions
+        if steps % 1024 == 0 {
+            select {
+            case <-done:
+                return ctx.Err()
+            default:
+            }
+        }
+
+        at := pc
+        ins := &code[pc]
+        pc++
+
+        var err error
+        top := len(stack) - 1
+
+        switch ins.Op {
+        case OpConst:
+            stack = append(stack, program.constants[ins.Arg])
+        case OpLoad:
+            variable := &program.variables[ins.Arg]
+            value := m.load(*variable)
+            if value == nil {
+                err = errors.New("Unknown variable " + variable.name)
+                break
+            }
+            stack = append(stack, value)
+        case OpLoadRaw:
+            stack = append(stack, m.load(program.variables[ins.Arg]))
+        case OpLoadParameter:
+            value := m.load(program.variables[ins.Arg])
+            if value == nil {
+                value = ""
+            }
+            stack = append(stack, value)
+        case OpAssign:
+            variable := program.variables[ins.Arg]
+            value := stack[top]
+            stack = stack[:top]
+
+            // Values of the type of the variable need no conversion
+            current := m.load(variable)
+            switch current.(type) {
+            case float64:
+                if _, ok := value.(float64); ok {
+                    m.store(variable, value)
+                    continue
+                }
+            case int64:
+                if _, ok := value.(int64); ok {
+                    m.store(variable, value)
+                    continue
+                }
+            }
+
+            value, err = program.nodes[at].(*SetNode).convert(current, value)
+            if err == nil {
+                m.store(variable, value)
+            }
+        case OpNot, OpNegate, OpComplement:
+            if number, ok := stack[top].(float64); ok && ins.Op == OpNegate {
+                stack[top] = -number
+                break
+            }
+            stack[top], err = applyUnary(unaryOperators[ins.Op - OpNot], stack[top])
+        case OpAdd, OpSubtract, OpMultiply, OpDivide, OpModulo, OpPower, OpBitAnd, OpBitOr, OpXor, OpShiftLeft, OpShiftRight,
+            OpEqual, OpNotEqual, OpLess, OpGreater, OpLessEqual, OpGreaterEqual:
+            stack[top - 1], err = binary(ins, stack[top - 1], stack[top])
+            stack = stack[:top]
+        case OpAnd, OpOr:
+            var b bool
+            b, err = logicalOperand(logicalOperators[ins.Op - OpAnd], stack[top])
+            if err == nil {
+                if (ins.Op == OpAnd) != b {
+                    pc = ins.Jump
+                } else {
+                    stack = stack[:top]
+                }
+            }
+        case OpLogical:
+            _, err = logicalOperand(logicalOperators[ins.Arg], stack[top])
+        case OpBuiltin:
+            call := &program.builtins[ins.Arg]
+            base := len(stack) - call.arguments
+            arguments := make([]interface{}, call.arguments)
+            copy(arguments, stack[base:])
+            stack = stack[:base]
+
+            var value interface{}
+            value, err = call.function(arguments...)
+            stack = append(stack, value)
+        case OpIndex:
+            stack[top - 1], err = indexValue(stack[top - 1], stack[top])
+            stack = stack[:top]
+        case OpField:
+            stack[top], err = fieldValue(stack[top], program.constants[ins.Arg].(string))
+        case OpNumber:
+            var number float64
+            number, err = numberValue(stack[top])
+            stack[top] = number
+        case OpTrace:
+            traceEvaluation(state.StdErr, program.constants[ins.Arg], stack[top])
+        case OpPrint:
+            state.StdOut.WriteString(program.constants[ins.Arg].(string))
+        case OpWrite:
+            state.StdOut.WriteString(formatValue(stack[top]))
+            stack = stack[:top]
+        case OpNewline:
+            state.StdOut.WriteRune('\n')
+            state.StdOut.Flush()
+        case OpList:
+            if _, ok := stack[top].(*List); !ok {
+                err = errors.New(program.constants[ins.Arg].(string))
+            }
+        case OpAppend:
+            stack[top - 1].(*List).Append(stack[top])
+            stack = stack[:top - 1]
+        case OpMap:
+            if _, ok := stack[top].(*Map); !ok {
+                err = errors.New(program.constants[ins.Arg].(string))
+            }
+        case OpDelete:
+            err = stack[top - 1].(*Map).Delete(stack[top])
+            stack = stack[:top - 1]
+        case OpPathIndex:
+            indexable, ok := stack[top - 1].(Indexable)
+            if !ok {
+                err = errors.New("set: " + typeOf(stack[top - 1]) + " can't be indexed")
+                break
+            }
+            stack[top - 1], err = indexable.Index(stack[top])
+            stack = stack[:top]
+        case OpPathField:
+            accessible, ok := stack[top].(Accessible)
+            if !ok {
+                err = errors.New("set: " + typeOf(stack[top]) + " has no fields")
+                break
+            }
+            stack[top], err = accessible.Field(program.constants[ins.Arg].(string))
+        case OpIndexSetter:
+            if _, ok := stack[top - 1].(IndexSetter); !ok {
+                err = errors.New("set: " + typeOf(stack[top - 1]) + " can't be indexed")
+            }
+        case OpFieldSetter:
+            if _, ok := stack[top].(FieldSetter); !ok {
+                err = errors.New("set: " + typeOf(stack[top]) + " has no fields")
+            }
+        case OpSetIndex:
+            err = stack[top - 2].(IndexSetter).SetIndex(stack[top - 1], stack[top])
+            stack = stack[:top - 2]
+        case OpSetField:
+            err = stack[top - 1].(FieldSetter).SetField(program.constants[ins.Arg].(string), stack[top])
+            stack = stack[:top - 1]
+        case OpRun:
+            statement := &program.statements[ins.Arg]
+            err = statement.statement.run(state, &m.scopes[statement.scope])
+        case OpJump:
+            pc = ins.Jump
+        case OpBranch:
+            var res float64
+            res, err = numberValue(stack[top])
+            stack = stack[:top]
+            if err == nil && res == 0 {
+                pc = ins.Jump
+            }
+        case OpFor:
+            start, limit, step := stack[top - 2].(float64), stack[top - 1].(float64), stack[top].(float64)
+            stack = stack[:top - 2]
+
+            if step == 0 {
+                err = errors.New("for: step must not be 0")
+                break
+            }
+
+            loop := &program.loops[ins.Arg]
+            m.store(loop[1], limit)
+            m.store(loop[2], step)
+            if !m.forStep(loop, start) {
+                pc = ins.Jump
+            }
+        case OpForNext:
+            loop := &program.loops[ins.Arg]
+            current, ok := m.load(loop[0]).(float64)
+            if !ok {
+                err = errors.New("for: Loop variable " + loop[0].name + " is no longer a number")
+            } else if m.forStep(loop, current + m.load(loop[2]).(float64)) {
+                pc = ins.Jump
+            }
+        case OpForEach:
+            var items []interface{}
+            items, err = loopItems(stack[top])
+            stack = stack[:top]
+            if err == nil {
+                loop := &program.loops[ins.Arg]
+                m.store(loop[1], items)
+                if !m.forEachStep(loop, 0) {
+                    pc = ins.Jump
+                }
+            }
+        case OpForEachNext:
+            loop := &program.loops[ins.Arg]
+            if m.forEachStep(loop, m.load(loop[2]).(int) + 1) {
+                pc = ins.Jump
+            }
+        case OpCall:
+            call := &program.calls[ins.Arg]
+            base := len(stack) - len(call.parameters)
+            pc, err = m.call(call, program.nodes[at].(*CallNode), stack[base:], pc, ins.Jump)
+            stack = stack[:base]
+        case OpResult:
+            stack[top], err = program.nodes[at].(*ReturnNode).convert(stack[top])
+        case OpReturn:
+            pc = m.leave(stack[top])
+            stack = stack[:top]
+        case OpEnd:
+            var res interface{}
+            if ins.Arg >= 0 {
+                res = m.load(program.variables[ins.Arg])
+            }
+            pc = m.leave(res)
+        }
+
+        if err != nil {
+            node := program.nodes[at]
+
+            if program.traceEval && (ins.Op == OpLoad || (ins.Op >= OpNot && ins.Op <= OpField)) {
+                traceFailure(state.StdErr, program, at)
+            }
+
+            try := state.unwindTo(node)
+            if try == nil {
+                return newRuntimeError(state, node, err)
+            }
+            m.sync()
+
+            if variable, ok := program.catches[try.Catch]; ok {
+                m.store(variable, err.Error())
+            }
+
+            // Errors only happen inside of statements, the values of the
+            // failed one are dropped
+            stack = stack[:0]
+            pc = program.start(try.Catch.Next())
+        }
+    }
+
+    return nil
+}
+
+// traceFailure traces the expression that failed at the instruction at, like
+// EvaluateValue does. Every expression ends with its OpTrace.
+func traceFailure(w io.Writer, program *Program, at int) {
+    var result interface{}
+
+    for _, ins := range program.Code[at:] {
+        if ins.Op == OpTrace {
+            traceEvaluation(w, program.constants[ins.Arg], result)
+            return
+        }
+    }
+}
+
+// binary applies the binary operator of ins. Numbers and ints are handled
+// directly, everything else like in the tree walker.
+func binary(ins *Instruction, value, rightValue interface{}) (interface{}, error) {
+    operator := binaryOperators[ins.Op - OpAdd]
+
+    switch a := value.(type) {
+    case float64:
+        switch b := rightValue.(type) {
+        case float64:
+            if result, ok := compareFloats(ins.Op, a, b); ok {
+                return result, nil
+            }
+
+            switch ins.Op {
+            case OpAdd:
+                return a + b, nil
+            case OpSubtract:
+                return a - b, nil
+            case OpMultiply:
+                return a * b, nil
+            case OpDivide:
+                return a / b, nil
+            }
+        case int64:
+            // A whole number literal combined with an int is an int
+            if left, ok := asInt(a, ins.Arg & 1 != 0); ok && ins.Op < OpEqual {
+                return applyIntArithmetic(operator, left, b)
+            }
+        }
+    case int64:
+        switch b := rightValue.(type) {
+        case int64:
+            if result, ok := compareInts(ins.Op, a, b); ok {
+                return result, nil
+            }
+
+            return applyIntArithmetic(operator, a, b)
+        case float64:
+            if right, ok := asInt(b, ins.Arg & 2 != 0); ok && ins.Op < OpEqual {
+                return applyIntArithmetic(operator, a, right)
+            }
+        }
+    }
+
+    return applyBinary(operator, value, rightValue, ins.Arg & 1 != 0, ins.Arg & 2 != 0)
+}
+
+// compareFloats applies a comparison to two numbers, it reports false for
+// other operators. Like compareNumbers, NaN is equal to everything.
+func compareFloats(op Opcode, a, b float64) (bool, bool) {
+    switch op {
+    case OpEqual:
+        return !(a < b || a > b), true
+    case OpNotEqual:
+        return a < b || a > b, true
+    case OpLess:
+        return a < b, true
+    case OpGreater:
+        return a > b, true
+    case OpLessEqual:
+        return !(a > b), true
+    case OpGreaterEqual:
+        return !(a < b), true
+    }
+
+    return false, false
+}
+
+// compareInts is compareFloats for ints
+func compareInts(op Opcode, a, b int64) (bool, bool) {
+    switch op {
+    case OpEqual:
+        return a == b, true
+    case OpNotEqual:
+        return a != b, true
+    case OpLess:
+        return a < b, true
+    case OpGreater:
+        return a > b, true
+    case OpLessEqual:
+        return a <= b, true
+    case OpGreaterEqual:
+        return a >= b, true
+    }
+
+    return false, false
+}
+
+// sync updates the cached innermost frame after the FunctionStack changed
+func (m *machine) sync() {
+    m.function, m.locals = nil, nil
+
+    stack := m.state.FunctionStack
+    if stack.Len() > 0 {
+        m.function = stack.Top().Function
+        m.locals = stack.Top().locals
+    }
+}
+
+// frame returns the storage of the variables of function
+func (m *machine) frame(function *FunctionDeclarationNode) []interface{} {
+    if function == nil {
+        return m.globals
+    }
+
+    if function == m.function {
+        return m.locals
+    }
+
+    // Like in RuntimeScope, functions declared inside of function use its
+    // invocation, outside of a call the declared values are used
+    if frame := m.state.frameOf(function); frame != nil {
+        return frame.locals
+    }
+
+    return m.program.locals[function]
+}
+
+func (m *machine) load(location slot) interface{} {
+    return m.frame(location.function)[location.index]
+}
+
+func (m *machine) store(location slot, value interface{}) {
+    m.frame(location.function)[location.index] = value
+}
+
+// forStep sets the loop variable of a for loop and reports whether the body
+// has to be executed
+func (m *machine) forStep(loop *loopSlots, value float64) bool {
+    m.store(loop[0], value)
+
+    limit := m.load(loop[1]).(float64)
+    step := m.load(loop[2]).(float64)
+
+    return !((step > 0 && value > limit) || (step < 0 && value < limit))
+}
+
+// forEachStep moves a foreach loop to the item at index and reports whether
+// there is one
+func (m *machine) forEachStep(loop *loopSlots, index int) bool {
+    items := m.load(loop[1]).([]interface{})
+
+    if index >= len(items) {
+        return false
+    }
+
+    m.store(loop[2], index)
+    m.store(loop[0], items[index])
+
+    return true
+}
+
+// call converts the arguments of a call and enters the function at start,
+// resume is the instruction following the call. It returns the instruction
+// to continue at.
+func (m *machine) call(call *callSite, node *CallNode, arguments []interface{}, resume int, start int) (int, error) {
+    fn := call.function
+
+    values := make([]interface{}, len(arguments))
+    for i, argument := range arguments {
+        value, err := convertValue(argument, fn.Parameters[i].Type)
+        if err != nil {
+            return resume, err
+        }
+        values[i] = value
+    }
+
+    declared := m.program.locals[fn]
+    frame := &Frame{Function: fn, Call: node, locals: make([]interface{}, len(declared)), resume: resume}
+    for i, v := range declared {
+        frame.locals[i] = freshValue(v)
+    }
+
+    for i, value := range values {
+        frame.locals[call.parameters[i].index] = value
+    }
+
+    m.state.pushFrame(frame)
+    m.function, m.locals = fn, frame.locals
+
+    return start, nil
+}
+
+// leave returns from the current function, storing value in the target of
+// the call. It returns the instruction to continue at.
+func (m *machine) leave(value interface{}) int {
+    frame := m.state.FunctionStack.Pop()
+    m.sync()
+
+    call := &m.program.calls[m.program.Code[frame.resume - 1].Arg]
+    if call.target != nil {
+        m.store(*call.target, value)
+    }
+
+    return frame.resume
+}
@@ -0,0 +1,253 @@
+package interpreter
+
+import (
+    "errors"
+    "log"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "unicode"
+)
+
+// module is a script loaded by an import statement. It is parsed with a top
+// level scope of its own, the scripts importing it only see its functions.
+type module struct {
+    path string
+    scope *Scope
+}
+
+// importedLines holds the lines of a script, each imported module follows
+// the statement importing it first
+type importedLines struct {
+    tokens [][]Token
+    // modules holds the module each line belongs to, nil for the lines of the script itself
+    modules []*module
+    // imports maps the index of each import statement to the module it imports
+    imports map[int]*module
+}
+
+type moduleLoader struct {
+    lines importedLines
+    // searchPath lists the directories modules are searched in, after the
+    // directory of the importing script
+    searchPath []string
+    // loaded maps absolute paths to the modules loaded so far, so every
+    // module is loaded once
+    loaded map[string]*module
+    // loading holds the modules whose lines are being added, the innermost last
+    loading []*module
+    diagnostics Diagnostics
+    logger *log.Logger
+}
+
+// loadModules adds the lines of the modules imported by a script
+func loadModules(tokens [][]Token, searchPath []string, logger *log.Logger) (*importedLines, error) {
+    l := &moduleLoader{lines: importedLines{imports: make(map[int]*module)}, searchPath: searchPath, loaded: make(map[string]*module), logger: logger}
+
+    // The script itself is loading, importing it again is a cycle
+    if len(tokens) > 0 {
+        l.loading = append(l.loading, &module{path: tokens[0][0].File})
+    }
+
+    l.add(tokens, nil)
+
+    if len(l.diagnostics) > 0 {
+        return nil, l.diagnostics
+    }
+
+    return &l.lines, nil
+}
+
+func (l *moduleLoader) add(tokens [][]Token, owner *module) {
+    for _, line := range tokens {
+        index := len(l.lines.tokens)
+        l.lines.tokens = append(l.lines.tokens, line)
+        l.lines.modules = append(l.lines.modules, owner)
+
+        if line[0].Text != "import" {
+            continue
+        }
+
+        name, _, err := parseImport(line)
+        if err != nil {
+            // Reported by the parser
+            continue
+        }
+
+        file, err := resolveModule(name, line[0].File, l.searchPath)
+        if err != nil {
+            l.diagnostics.add(line[1], err.Error())
+            continue
+        }
+        key := moduleKey(file)
+
+        if cycle := l.cycle(key); cycle != nil {
+            l.diagnostics.add(line[1], "Import cycle: " + strings.Join(append(cycle, file), " -> "))
+            continue
+        }
+
+        if m, ok := l.loaded[key]; ok {
+            l.lines.imports[index] = m
+            continue
+        }
+
+        l.logger.Println("Importing module \"" + file + "\"...")
+
+        moduleTokens, err := tokenizeModule(file, l.logger)
+        if diagnostics, ok := err.(Diagnostics); ok {
+            l.diagnostics = append(l.diagnostics, diagnostics...)
+            continue
+        }
+        if err != nil {
+            l.diagnostics.add(line[1], "Can't import " + name + ": " + err.Error())
+            continue
+        }
+
+        m := &module{path: file, scope: NewScope(DummyScope)}
+        l.loaded[key] = m
+        l.lines.imports[index] = m
+
+        l.loading = append(l.loading, m)
+        l.add(moduleTokens, m)
+        l.loading = l.loading[:len(l.loading) - 1]
+    }
+}
+
+// cycle returns the paths of the modules that lead back to the module at key
+// while it is still loading, nil if it isn't
+func (l *moduleLoader) cycle(key string) []string {
+    for i, loading := range l.loading {
+        if moduleKey(loading.path) != key {
+            continue
+        }
+
+        var cycle []string
+        for _, m := range l.loading[i:] {
+            cycle = append(cycle, m.path)
+        }
+
+        return cycle
+    }
+
+    return nil
+}
+
+// parseImport reads an import statement, import "<module>" [as <name>]. The
+// name defaults to the file name of the module without its extension.
+func parseImport(line []Token) (string, string, error) {
+    if len(line) < 2 || line[1].Kind != TokenString {
+        return "", "", errors.New("Invalid import syntax, expected import \"<module>\" [as <name>]")
+    }
+
+    name := line[1].Value
+    alias := strings.TrimSuffix(path.Base(name), path.Ext(name))
+
+    switch {
+    case len(line) == 4 && line[2].Text == "as" && line[3].Kind == TokenIdentifier:
+        alias = line[3].Text
+    case len(line) != 2:
+        return "", "", errors.New("Invalid import syntax, expected import \"<module>\" [as <name>]")
+    }
+
+    if !isIdentifier(alias) {
+        return "", "", errors.New("Module " + name + " needs a name to be imported as, use import \"" + name + "\" as <name>")
+    }
+
+    return name, alias, nil
+}
+
+func isIdentifier(name string) bool {
+    for i, c := range name {
+        if !unicode.IsLetter(c) && c != '_' && (i == 0 || !unicode.IsDigit(c)) {
+            return false
+        }
+    }
+
+    return name != ""
+}
+
+// resolveModule returns the file of the module name imported by the script
+// from. Modules are searched relative to the importing script first, then in
+// the directories of searchPath in order. The .xii extension can be left out.
+func resolveModule(name string, from string, searchPath []string) (string, error) {
+    file := name
+    if path.Ext(file) == "" {
+        file += ".xii"
+    }
+
+    if filepath.IsAbs(file) {
+        return file, nil
+    }
+
+    dirs := append([]string{filepath.Dir(from)}, searchPath...)
+    for _, dir := range dirs {
+        candidate := filepath.Join(dir, file)
+        if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+            return candidate, nil
+        }
+    }
+
+    return "", errors.New("Can't find module " + name + ", tried " + strings.Join(dirs, ", "))
+}
+
+// DefaultModulePath returns the directories imports are searched in by
+// default: the ones listed in the XIIPATH environment variable, followed by
+// the standard library.
+func DefaultModulePath() []string {
+    var dirs []string
+    for _, dir := range filepath.SplitList(os.Getenv("XIIPATH")) {
+        if dir != "" {
+            dirs = append(dirs, dir)
+        }
+    }
+
+    return append(dirs, StdlibDir())
+}
+
+// StdlibDir returns the directory of the modules bundled with XiiLang, the
+// one given in the XIISTDLIB environment variable or else the stdlib
+// directory next to the executable
+func StdlibDir() string {
+    if dir := os.Getenv("XIISTDLIB"); dir != "" {
+        return dir
+    }
+
+    executable, err := os.Executable()
+    if err != nil {
+        return "stdlib"
+    }
+
+    return filepath.Join(filepath.Dir(executable), "stdlib")
+}
+
+// moduleKey identifies the file of a module, no matter how its path is written
+func moduleKey(file string) string {
+    key, err := filepath.Abs(file)
+    if err != nil {
+        return file
+    }
+
+    return key
+}
+
+// tokenizeModule tokenizes a module, modules without statements are allowed
+func tokenizeModule(file string, logger *log.Logger) ([][]Token, error) {
+    inFile, err := os.Open(file)
+    if err != nil {
+        return nil, err
+    }
+    defer inFile.Close()
+
+    t := &tokenizer{logger: logger}
+    err = t.read(file, inFile)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(t.diagnostics) > 0 {
+        return nil, t.diagnostics
+    }
+
+    return t.lines, nil
+}
@@ -2,8 +2,10 @@ package interpreter
 
 import (
     "strconv"
+    "strings"
     "errors"
     "fmt"
+    "io"
 )
 
 type Node struct {
@@ -13,6 +15,8 @@ type Node struct {
     NextNode, PreviousNode INode
     Trace string
     Scope *Scope
+    // Position is the keyword token the node was parsed from
+    Position Token
 }
 
 type INode interface {
@@ -23,6 +27,7 @@ type INode interface {
     GetKeyword() string
     GetID() int
     GetTrace() string
+    GetPosition() Token
     GetScope() *Scope
 }
 
@@ -45,6 +50,189 @@ func (node *LiteralDeclarationNode) Execute(state *XiiState) error {
 }
 
 
+type IntDeclarationNode struct {
+    Node
+}
+
+func (node *IntDeclarationNode) Execute(state *XiiState) error {
+    return nil
+}
+
+
+type BoolDeclarationNode struct {
+    Node
+}
+
+func (node *BoolDeclarationNode) Execute(state *XiiState) error {
+    return nil
+}
+
+
+type ListDeclarationNode struct {
+    Node
+}
+
+func (node *ListDeclarationNode) Execute(state *XiiState) error {
+    return nil
+}
+
+
+type MapDeclarationNode struct {
+    Node
+}
+
+func (node *MapDeclarationNode) Execute(state *XiiState) error {
+    return nil
+}
+
+
+type StructDefinitionNode struct {
+    Node
+    Type *StructType
+    nextAfterEnd INode
+}
+
+func (node *StructDefinitionNode) Init(nodes []INode) error {
+    nextEnd := findNextEndNode(node)
+
+    if nextEnd == nil {
+        return errors.New("A struct node requires a matching end node")
+    }
+
+    node.nextAfterEnd = nextEnd.Next()
+
+    return nil
+}
+
+func (node *StructDefinitionNode) Execute(state *XiiState) error {
+    // The fields are only a declaration, there is nothing to execute
+    state.NextNode = node.nextAfterEnd
+
+    return nil
+}
+
+
+type FieldDefinitionNode struct {
+    Node
+}
+
+func (node *FieldDefinitionNode) Execute(state *XiiState) error {
+    return nil
+}
+
+
+// ImportNode makes the functions of a module available under a name. The
+// module is run where it is imported first, its nodes follow this one.
+type ImportNode struct {
+    Node
+    // Module is the path of the imported file
+    Module string
+}
+
+func (node *ImportNode) Execute(state *XiiState) error {
+    return nil
+}
+
+
+type StructDeclarationNode struct {
+    Node
+}
+
+func (node *StructDeclarationNode) Execute(state *XiiState) error {
+    return nil
+}
+
+
+type DeleteNode struct {
+    Node
+    target *Expression
+    key *Expression
+}
+
+func (node *DeleteNode) Init(nodes []INode) error {
+    var err error
+
+    node.target, err = NewExpression(node.Parameter[:1], node.GetScope())
+    if err != nil {
+        return err
+    }
+
+    node.key, err = NewExpression(node.Parameter[1:], node.GetScope())
+
+    return err
+}
+
+func (node *DeleteNode) Execute(state *XiiState) error {
+    return node.run(state, state.ScopeOf(node))
+}
+
+func (node *DeleteNode) run(state *XiiState, scope Variables) error {
+
+    target, err := EvaluateValue(state, scope, node.target)
+    if err != nil {
+        return err
+    }
+
+    m, ok := target.(*Map)
+    if !ok {
+        return errors.New("delete: " + node.Parameter[0].GetRaw() + " is not a map")
+    }
+
+    key, err := EvaluateValue(state, scope, node.key)
+    if err != nil {
+        return err
+    }
+
+    return m.Delete(key)
+}
+
+
+type AppendNode struct {
+    Node
+    list *Expression
+    expression *Expression
+}
+
+func (node *AppendNode) Init(nodes []INode) error {
+    var err error
+
+    node.list, err = NewExpression(node.Parameter[:1], node.GetScope())
+    if err != nil {
+        return err
+    }
+
+    node.expression, err = NewExpression(node.Parameter[1:], node.GetScope())
+
+    return err
+}
+
+func (node *AppendNode) Execute(state *XiiState) error {
+    return node.run(state, state.ScopeOf(node))
+}
+
+func (node *AppendNode) run(state *XiiState, scope Variables) error {
+
+    target, err := EvaluateValue(state, scope, node.list)
+    if err != nil {
+        return err
+    }
+
+    list, ok := target.(*List)
+    if !ok {
+        return errors.New("append: " + node.Parameter[0].GetRaw() + " is not a list")
+    }
+
+    value, err := EvaluateValue(state, scope, node.expression)
+    if err != nil {
+        return err
+    }
+
+    list.Append(value)
+
+    return nil
+}
+
+
 type Passer struct {
     Name string
     Type string
@@ -53,140 +241,685 @@ type Passer struct {
 
 type FunctionDeclarationNode struct {
     Node
+    Name string
     Parameters []Passer
+    // Result is the declared return variable, its Name is empty for functions without a return value
+    Result Passer
+    // BodyScope holds the parameters and local variables of the function
+    BodyScope *Scope
     nextAfterEnd INode
+    // parameterSlots locate the parameters in BodyScope
+    parameterSlots []variableSlot
+    // scopes holds BodyScope and the scopes nested in it, indexed by Scope.index
+    scopes []*Scope
 }
 
 func (node *FunctionDeclarationNode) Init(nodes []INode) error {
     nextEnd := findNextEndNode(node)
 
-    if nextEnd == nil {
-        return errors.New("A function node requires a matching end node")
+    if nextEnd == nil {
+        return errors.New("A function node requires a matching end node")
+    }
+
+    node.nextAfterEnd = nextEnd.Next()
+
+    node.parameterSlots = make([]variableSlot, len(node.Parameters))
+    for i, passer := range node.Parameters {
+        node.parameterSlots[i], _ = node.BodyScope.resolveSlot(passer.Name)
+    }
+
+    return nil
+}
+
+func (node *FunctionDeclarationNode) Execute(state *XiiState) error {
+    // The body is only entered through a CallNode
+    state.NextNode = node.nextAfterEnd
+    
+    return nil
+}
+
+
+type CallNode struct {
+    Node
+    Passers map[string]IParameter
+    // Target is the variable receiving the return value, empty if the result is discarded
+    Target string
+    target variableSlot
+}
+
+func (node *CallNode) Init(nodes []INode) error {
+    if node.Target != "" {
+        node.target, _ = node.GetScope().resolveSlot(node.Target)
+    }
+
+    return nil
+}
+
+func (node *CallNode) Execute(state *XiiState) error {
+    fun := node.GetScope().GetFunctionNode(node.Parameter[0].GetRaw())
+    if fun == nil {
+        return errors.New("Tried to call non-existing function")
+    }
+
+    fn := fun.(*FunctionDeclarationNode)
+
+    values, err := node.parameterValues(state, fn, state.ScopeOf(node))
+    if err != nil {
+        return err
+    }
+
+    state.pushFrame(NewFrame(node, fn))
+
+    body := state.RuntimeScope(fn.BodyScope)
+    for i, value := range values {
+        body.store(fn.parameterSlots[i], value)
+    }
+
+    state.NextNode = fn.Next()
+
+    return nil
+}
+
+// arguments evaluates the values passed to the function in the calling scope
+func (node *CallNode) arguments(state *XiiState, scope Variables) (map[string]interface{}, error) {
+    passingArea := make(map[string]interface{}, len(node.Passers))
+    for k, v := range node.Passers {
+        value, err := evaluateParameter(state, v, scope)
+        if err != nil {
+            return nil, err
+        }
+        passingArea[k] = value
+    }
+
+    return passingArea, nil
+}
+
+// parameterValues returns the values of the parameters of fn in order, converted
+// to their types. Nothing may fail after the frame of the call is pushed, so
+// this happens before.
+func (node *CallNode) parameterValues(state *XiiState, fn *FunctionDeclarationNode, scope Variables) ([]interface{}, error) {
+    passingArea, err := node.arguments(state, scope)
+    if err != nil {
+        return nil, err
+    }
+
+    values := make([]interface{}, len(fn.Parameters))
+    for i, passer := range fn.Parameters {
+        values[i], err = convertValue(passingArea[passer.Name], passer.Type)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return values, nil
+}
+
+
+// returnFromFunction leaves the function that is currently executing and
+// hands value over to the variable the caller wants the result stored in.
+func returnFromFunction(state *XiiState, value interface{}) {
+    caller := state.FunctionStack.Pop().Call
+
+    if caller.Target != "" {
+        state.ScopeOf(caller).store(caller.target, value)
+    }
+
+    state.NextNode = caller.Next()
+}
+
+
+type ReturnNode struct {
+    Node
+    Function *FunctionDeclarationNode
+    expression *Expression
+    // resultSlot locates the result variable, returned if there is no expression
+    resultSlot variableSlot
+}
+
+func (node *ReturnNode) Init(nodes []INode) error {
+    if len(node.Parameter) == 0 {
+        node.resultSlot, _ = node.GetScope().resolveSlot(node.Function.Result.Name)
+        return nil
+    }
+
+    exp, err := NewExpression(node.Parameter, node.GetScope())
+
+    if err != nil {
+        return err
+    }
+
+    node.expression = exp
+
+    return nil
+}
+
+func (node *ReturnNode) Execute(state *XiiState) error {
+    res, err := node.result(state, state.ScopeOf(node))
+
+    if err != nil {
+        return err
+    }
+
+    returnFromFunction(state, res)
+
+    return nil
+}
+
+// result computes the value the function returns
+func (node *ReturnNode) result(state *XiiState, scope Variables) (interface{}, error) {
+    result := node.Function.Result
+
+    if result.Name == "" {
+        return nil, nil
+    }
+
+    if node.expression == nil {
+        return scope.load(node.resultSlot), nil
+    }
+
+    res, err := EvaluateValue(state, scope, node.expression)
+
+    if err != nil {
+        return nil, err
+    }
+
+    return node.convert(res)
+}
+
+// convert checks the value of the expression against the result type of the function
+func (node *ReturnNode) convert(res interface{}) (interface{}, error) {
+    result := node.Function.Result
+
+    res, err := convertValue(res, result.Type)
+
+    if err != nil {
+        return nil, err
+    }
+
+    if typeOf(res) != result.Type {
+        if result.Type != "string" || typeOf(res) != "number" {
+            return nil, errors.New("return: Function " + node.Function.Name + " has to return a " + result.Type)
+        }
+
+        res = formatValue(res)
+    }
+
+    return res, nil
+}
+
+
+type OutputNode struct {
+    Node
+}
+
+func (node *OutputNode) Execute(state *XiiState) error {
+    return node.run(state, state.ScopeOf(node))
+}
+
+func (node *OutputNode) run(state *XiiState, scope Variables) error {
+    for i, n := range node.Parameter {
+        _, ok := n.(VariableParameter)
+        if i != 0 && !ok {
+            state.StdOut.WriteRune(' ')
+        }
+
+        exp, isExp := n.(*ExpressionParameter)
+        if isExp {
+            value, err := exp.Evaluate(state, scope)
+            if err != nil {
+                return err
+            }
+            state.StdOut.WriteString(formatValue(value))
+            continue
+        }
+
+        state.StdOut.WriteString(n.GetText(scope))
+    }
+
+    state.StdOut.WriteRune('\n')
+
+    state.StdOut.Flush()
+
+    return nil
+}
+
+
+type InputNode struct {
+    Node
+    variable variableSlot
+    declared bool
+}
+
+func (node *InputNode) Init(nodes []INode) error {
+    if len(node.Parameter) == 1 {
+        node.variable, node.declared = node.GetScope().resolveSlot(node.Parameter[0].GetRaw())
+    }
+
+    return nil
+}
+
+func (node *InputNode) Execute(state *XiiState) error {
+    return node.run(state, state.ScopeOf(node))
+}
+
+func (node *InputNode) run(state *XiiState, scope Variables) error {
+    if len(node.Parameter) != 1 {
+        return errors.New("in: No parameter name given (or too many)")
+    }
+
+    if !node.declared {
+        return errors.New("Tried to 'in' not existing variable")
+    }
+
+    variable := scope.load(node.variable)
+
+    if variable == nil {
+        return errors.New("Tried to 'in' not existing variable")
+    }
+
+    var parse func(text string) (interface{}, error)
+    switch variable.(type) {
+    case string:
+        parse = func(text string) (interface{}, error) { return text, nil }
+    case float64:
+        parse = func(text string) (interface{}, error) { return strconv.ParseFloat(text, 64) }
+    case int64:
+        parse = func(text string) (interface{}, error) { return strconv.ParseInt(text, 10, 64) }
+    case bool:
+        parse = func(text string) (interface{}, error) { return strconv.ParseBool(text) }
+    default:
+        return errors.New("in: Unknown variable cannot be read into")
+    }
+
+    for {
+        text, err := readLine(state)
+        if err != nil {
+            return err
+        }
+
+        value, err := parse(text)
+        if err == nil {
+            scope.store(node.variable, value)
+            return nil
+        }
+
+        state.StdOut.WriteString("Please retry: " + err.Error() + "\n")
+        state.StdOut.Flush()
+    }
+}
+
+
+func readLine(state *XiiState) (string, error) {
+    text, err := state.StdIn.ReadString('\n')
+    if err != nil && (err != io.EOF || text == "") {
+        return "", errors.New("in: Could not read input: " + err.Error())
+    }
+
+    return strings.TrimSpace(text), nil
+}
+
+
+type LoopNode struct {
+    Node
+    nextAfterEndNode INode
+    expression *Expression
+}
+
+func (node *LoopNode) Init(nodes []INode) error {
+    nextEnd := findNextEndNode(node)
+
+    if nextEnd == nil {
+        return errors.New("A loop node requires a matching end node")
+    }
+
+    node.nextAfterEndNode = nextEnd.Next()
+
+    exp, err := NewExpression(node.Parameter, node.GetScope())
+
+    if err != nil {
+        return err
+    }
+
+    node.expression = exp
+
+    return nil
+}
+
+func (node *LoopNode) Continue(state *XiiState) error {
+    state.NextNode = node
+
+    return nil
+}
+
+func (node *LoopNode) AfterEnd() INode {
+    return node.nextAfterEndNode
+}
+
+func (node *LoopNode) Execute(state *XiiState) error {
+    res, err := Evaluate(state, state.ScopeOf(node), node.expression)
+
+    if err != nil {
+        return err
+    }
+
+    if res == 0 {
+        state.NextNode = node.nextAfterEndNode
+    }
+
+    return nil
+}
+
+
+// statementNode is implemented by nodes that only read and write variables
+// without changing the control flow. The bytecode machine runs the ones it
+// has no instructions for as they are.
+type statementNode interface {
+    INode
+    run(state *XiiState, scope Variables) error
+}
+
+
+// ILoopNode is implemented by all nodes that open a loop block
+type ILoopNode interface {
+    INode
+    // Continue starts the next iteration of the loop, or leaves it if it is done
+    Continue(state *XiiState) error
+    // AfterEnd returns the node following the end of the loop
+    AfterEnd() INode
+}
+
+
+type ForNode struct {
+    Node
+    Variable string
+    // BodyScope contains the loop variable and the bounds of the running loop
+    BodyScope *Scope
+    nextAfterEndNode INode
+    start, limit, step *Expression
+}
+
+// Names of the hidden variables storing the evaluated bounds, they can't
+// collide with user variables as they are not valid identifiers.
+const (
+    forLimitVariable = "for:limit"
+    forStepVariable = "for:step"
+)
+
+// The body scope of a for loop starts with the loop variable, followed by the
+// hidden variables. ParseTokens declares them in this order.
+const (
+    forVariableAt = iota
+    forLimitAt
+    forStepAt
+)
+
+func (node *ForNode) Init(nodes []INode) error {
+    nextEnd := findNextEndNode(node)
+
+    if nextEnd == nil {
+        return errors.New("A for node requires a matching end node")
+    }
+
+    node.nextAfterEndNode = nextEnd.Next()
+
+    // for <var> = <start> to <limit> [step <step>]
+    if len(node.Parameter) < 2 || node.Parameter[1].GetRaw() != "=" {
+        return errors.New("for: Invalid for syntax, expected for <var> = <start> to <end> [step <n>]")
+    }
+
+    parts := [][]IParameter{nil}
+    for _, p := range node.Parameter[2:] {
+        raw := p.GetRaw()
+        if (raw == "to" && len(parts) == 1) || (raw == "step" && len(parts) == 2) {
+            parts = append(parts, nil)
+            continue
+        }
+        parts[len(parts) - 1] = append(parts[len(parts) - 1], p)
+    }
+
+    if len(parts) < 2 {
+        return errors.New("for: Missing to <end>")
+    }
+
+    var err error
+
+    node.start, err = NewExpression(parts[0], node.GetScope())
+    if err != nil {
+        return err
+    }
+
+    node.limit, err = NewExpression(parts[1], node.GetScope())
+    if err != nil {
+        return err
+    }
+
+    if len(parts) == 3 {
+        node.step, err = NewExpression(parts[2], node.GetScope())
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (node *ForNode) Execute(state *XiiState) error {
+    start, limit, step, err := node.bounds(state, state.ScopeOf(node))
+    if err != nil {
+        return err
+    }
+
+    body := state.RuntimeScope(node.BodyScope)
+    body.variables[forLimitAt] = limit
+    body.variables[forStepAt] = step
+
+    return node.iterate(state, body, start)
+}
+
+// bounds evaluates the start, limit and step of the loop
+func (node *ForNode) bounds(state *XiiState, scope Variables) (start, limit, step float64, err error) {
+    start, err = Evaluate(state, scope, node.start)
+    if err != nil {
+        return
+    }
+
+    limit, err = Evaluate(state, scope, node.limit)
+    if err != nil {
+        return
+    }
+
+    step = 1
+    if node.step != nil {
+        step, err = Evaluate(state, scope, node.step)
+        if err != nil {
+            return
+        }
+
+        if step == 0 {
+            err = errors.New("for: step must not be 0")
+        }
+    }
+
+    return
+}
+
+func (node *ForNode) Continue(state *XiiState) error {
+    body := state.RuntimeScope(node.BodyScope)
+
+    current, ok := body.variables[forVariableAt].(float64)
+    if !ok {
+        return errors.New("for: Loop variable " + node.Variable + " is no longer a number")
+    }
+
+    return node.iterate(state, body, current + body.variables[forStepAt].(float64))
+}
+
+func (node *ForNode) AfterEnd() INode {
+    return node.nextAfterEndNode
+}
+
+func (node *ForNode) iterate(state *XiiState, body *Scope, value float64) error {
+    body.variables[forVariableAt] = value
+
+    limit := body.variables[forLimitAt].(float64)
+    step := body.variables[forStepAt].(float64)
+
+    if (step > 0 && value > limit) || (step < 0 && value < limit) {
+        state.NextNode = node.nextAfterEndNode
+    } else {
+        state.NextNode = node.Next()
+    }
+
+    return nil
+}
+
+
+type ForEachNode struct {
+    Node
+    Variable string
+    // BodyScope contains the loop variable and the items of the running loop
+    BodyScope *Scope
+    nextAfterEndNode INode
+    expression *Expression
+}
+
+const (
+    forEachItemsVariable = "foreach:items"
+    forEachIndexVariable = "foreach:index"
+)
+
+// Like for loops, the body scope starts with the loop variable and the hidden variables
+const (
+    forEachVariableAt = iota
+    forEachItemsAt
+    forEachIndexAt
+)
+
+func (node *ForEachNode) Init(nodes []INode) error {
+    nextEnd := findNextEndNode(node)
+
+    if nextEnd == nil {
+        return errors.New("A foreach node requires a matching end node")
+    }
+
+    node.nextAfterEndNode = nextEnd.Next()
+
+    exp, err := NewExpression(node.Parameter[2:], node.GetScope())
+
+    if err != nil {
+        return err
+    }
+
+    node.expression = exp
+
+    return nil
+}
+
+func (node *ForEachNode) Execute(state *XiiState) error {
+    items, err := node.items(state, state.ScopeOf(node))
+    if err != nil {
+        return err
+    }
+
+    body := state.RuntimeScope(node.BodyScope)
+    body.variables[forEachItemsAt] = items
+
+    return node.iterate(state, body, 0)
+}
+
+// items evaluates the collection and returns the values the loop visits
+func (node *ForEachNode) items(state *XiiState, scope Variables) ([]interface{}, error) {
+    collection, err := EvaluateValue(state, scope, node.expression)
+    if err != nil {
+        return nil, err
     }
 
-    node.nextAfterEnd = nextEnd.Next()
-
-    return nil
+    return loopItems(collection)
 }
 
-func (node *FunctionDeclarationNode) Execute(state *XiiState) error {
-    if state.PassingArea == nil {
-        state.NextNode = node.nextAfterEnd
-    } else {
-        for k, v := range state.PassingArea {
-            node.GetScope().SetVar(k, v)
+// loopItems returns the values a foreach loop over collection visits
+func loopItems(collection interface{}) ([]interface{}, error) {
+    var items []interface{}
+    switch v := collection.(type) {
+    case *List:
+        // Iterate over a snapshot, appending inside of the loop is allowed
+        items = append(items, v.Items...)
+    case *Map:
+        for _, k := range v.Keys() {
+            items = append(items, k)
         }
-        state.PassingArea = nil
+    default:
+        return nil, errors.New("foreach: Can't iterate over " + typeOf(collection))
     }
-    
-    return nil
+
+    return items, nil
 }
 
+func (node *ForEachNode) Continue(state *XiiState) error {
+    body := state.RuntimeScope(node.BodyScope)
 
-type CallNode struct {
-    Node
-    Passers map[string]IParameter
+    return node.iterate(state, body, body.variables[forEachIndexAt].(int) + 1)
 }
 
-func (node *CallNode) Execute(state *XiiState) error {
-    fun := node.GetScope().GetFunctionNode(node.Parameter[0].GetRaw())
-    if fun == nil {
-        return errors.New("Tried to call non-existing function")
-    }
+func (node *ForEachNode) AfterEnd() INode {
+    return node.nextAfterEndNode
+}
 
-    state.PassingArea = make(map[string]interface{}, 0)
-    for k, v := range node.Passers {
-        state.PassingArea[k] = v.GetValue(node.GetScope())
+func (node *ForEachNode) iterate(state *XiiState, body *Scope, index int) error {
+    items := body.variables[forEachItemsAt].([]interface{})
+
+    if index >= len(items) {
+        state.NextNode = node.nextAfterEndNode
+        return nil
     }
 
-    state.NextNode = fun
-    state.FunctionStack.Push(node)
+    body.variables[forEachIndexAt] = index
+    body.variables[forEachVariableAt] = items[index]
+    state.NextNode = node.Next()
 
     return nil
 }
 
 
-type OutputNode struct {
+type BreakNode struct {
     Node
+    Loop ILoopNode
 }
 
-func (node *OutputNode) Execute(state *XiiState) error {
-    for i, n := range node.Parameter {
-        _, ok := n.(VariableParameter)
-        if i != 0 && !ok {
-            state.StdOut.WriteRune(' ')
-        }
-        state.StdOut.WriteString(n.GetText(node.GetScope()))
-    }
-
-    state.StdOut.WriteRune('\n')
-
-    state.StdOut.Flush()
+func (node *BreakNode) Execute(state *XiiState) error {
+    state.NextNode = node.Loop.AfterEnd()
 
     return nil
 }
 
 
-type InputNode struct {
+type ContinueNode struct {
     Node
+    Loop ILoopNode
 }
 
-func (node *InputNode) Execute(state *XiiState) error {
-    if len(node.Parameter) != 1 {
-        return errors.New("in: No parameter name given (or too many)")
-    }
-
-    varname := node.Parameter[0].GetRaw()
-    variable := node.GetScope().GetVar(varname)
-
-    if variable == nil {
-        return errors.New("Tried to 'in' not existing variable")
-    }
-
-    _, ok1 := variable.(string)
-    _, ok2 := variable.(float64)
-
-    if ok1 || ok2 {
-        var text string
-        fmt.Scanln(&text)
-        if ok1 {
-            node.GetScope().SetVar(varname, text)
-        } else if ok2 {
-            for {
-                num, err := strconv.ParseFloat(text, 64)
-                if err == nil {
-                    node.GetScope().SetVar(varname, num)
-                    break
-                } else {
-                    fmt.Println("Please retry: " + err.Error())
-                    fmt.Scanln(&text)
-                }
-            }
-        }
-    } else {
-        return errors.New("in: Unknown variable cannot be read into")
-    }
-
-    return nil
+func (node *ContinueNode) Execute(state *XiiState) error {
+    return node.Loop.Continue(state)
 }
 
 
-type LoopNode struct {
+type ConditionNode struct {
     Node
-    nextAfterEndNode INode
+    // nextBranch is the else/elseif node belonging to this condition, or its end node
+    nextBranch INode
     expression *Expression
 }
 
-func (node *LoopNode) Init(nodes []INode) error {
+func (node *ConditionNode) Init(nodes []INode) error {
     nextEnd := findNextEndNode(node)
 
     if nextEnd == nil {
-        return errors.New("A loop node requires a matching end node")
+        return errors.New("A condition node requires a matching end node")
     }
+    
+    node.nextBranch = findNextBranchNode(node)
 
-    node.nextAfterEndNode = nextEnd.Next()
-
-    exp, err := NewExpression(node.Parameter)
+    exp, err := NewExpression(node.Parameter, node.GetScope())
 
     if err != nil {
         return err
@@ -197,37 +930,44 @@ func (node *LoopNode) Init(nodes []INode) error {
     return nil
 }
 
-func (node *LoopNode) Execute(state *XiiState) error {
-    res, err := Evaluate(node, node.expression)
+func (node *ConditionNode) Execute(state *XiiState) error {
+    res, err := Evaluate(state, state.ScopeOf(node), node.expression)
 
     if err != nil {
         return err
     }
 
     if res == 0 {
-        state.NextNode = node.nextAfterEndNode
+        return enterNextBranch(state, node.nextBranch)
     }
 
     return nil
 }
 
 
-type ConditionNode struct {
+// ElseNode handles both else and elseif, an else has no expression.
+type ElseNode struct {
     Node
-    nextEndNode INode
+    nextBranch INode
+    nextAfterEnd INode
     expression *Expression
 }
 
-func (node *ConditionNode) Init(nodes []INode) error {
+func (node *ElseNode) Init(nodes []INode) error {
     nextEnd := findNextEndNode(node)
 
     if nextEnd == nil {
-        return errors.New("A condition node requires a matching end node")
+        return errors.New("An else node requires a matching end node")
+    }
+
+    node.nextAfterEnd = nextEnd.Next()
+    node.nextBranch = findNextBranchNode(node)
+
+    if node.Keyword == "else" {
+        return nil
     }
-    
-    node.nextEndNode = nextEnd.Next()
 
-    exp, err := NewExpression(node.Parameter)
+    exp, err := NewExpression(node.Parameter, node.GetScope())
 
     if err != nil {
         return err
@@ -238,25 +978,115 @@ func (node *ConditionNode) Init(nodes []INode) error {
     return nil
 }
 
-func (node *ConditionNode) Execute(state *XiiState) error {
-    res, err := Evaluate(node, node.expression)
+func (node *ElseNode) Execute(state *XiiState) error {
+    // Reaching an else in sequence means the previous branch was taken
+    state.NextNode = node.nextAfterEnd
 
-    if err != nil {
-        return err
+    return nil
+}
+
+// enterNextBranch is used after a condition failed, it checks the following
+// elseif conditions and continues in the first branch that applies.
+func enterNextBranch(state *XiiState, branch INode) error {
+    for {
+        elseNode, ok := branch.(*ElseNode)
+        if !ok {
+            state.NextNode = branch.Next()
+            return nil
+        }
+
+        if elseNode.expression == nil {
+            state.NextNode = elseNode.Next()
+            return nil
+        }
+
+        res, err := Evaluate(state, state.ScopeOf(elseNode), elseNode.expression)
+
+        if err != nil {
+            return err
+        }
+
+        if res != 0 {
+            state.NextNode = elseNode.Next()
+            return nil
+        }
+
+        branch = elseNode.nextBranch
     }
+}
 
-    if res == 0 {
-        state.NextNode = node.nextEndNode
+
+type TryNode struct {
+    Node
+    // Catch is set by the parser once the catch branch is found
+    Catch *CatchNode
+}
+
+func (node *TryNode) Execute(state *XiiState) error {
+    return nil
+}
+
+
+type CatchNode struct {
+    Node
+    // Variable receives the error message, it may be empty
+    Variable string
+    BodyScope *Scope
+    nextAfterEnd INode
+}
+
+func (node *CatchNode) Init(nodes []INode) error {
+    nextEnd := findNextEndNode(node)
+
+    if nextEnd == nil {
+        return errors.New("A catch node requires a matching end node")
     }
 
+    node.nextAfterEnd = nextEnd.Next()
+
+    return nil
+}
+
+func (node *CatchNode) Execute(state *XiiState) error {
+    // Reaching the catch in sequence means the try block succeeded
+    state.NextNode = node.nextAfterEnd
+
     return nil
 }
 
 
+type ThrowNode struct {
+    Node
+}
+
+func (node *ThrowNode) Execute(state *XiiState) error {
+    return node.run(state, state.ScopeOf(node))
+}
+
+func (node *ThrowNode) run(state *XiiState, scope Variables) error {
+    return errors.New(concatParameters(node.Parameter, scope))
+}
+
+// concatParameters joins the texts of parameters with spaces
+func concatParameters(parameters []IParameter, scope Variables) string {
+    var text string
+    for i, v := range parameters {
+        if i > 0 {
+            text += " "
+        }
+        text += v.GetText(scope)
+    }
+
+    return text
+}
+
+
 type BlockEndNode struct {
     Node
-    companionNode INode
-    endsFunction bool
+    companionNode ILoopNode
+    endsFunction *FunctionDeclarationNode
+    // result locates the result variable of endsFunction
+    result variableSlot
 }
 
 func (node *BlockEndNode) Init(nodes []INode) error {
@@ -269,16 +1099,22 @@ func (node *BlockEndNode) Init(nodes []INode) error {
             if counter == 0 {
                 return nil
             }
-        case (*LoopNode):
+        case (*LoopNode), (*ForNode), (*ForEachNode):
             counter--
             if counter == 0 {
-                node.companionNode = companion
+                node.companionNode = companion.(ILoopNode)
                 return nil
             }
         case (*FunctionDeclarationNode):
             counter--
             if counter == 0 {
-                node.endsFunction = true
+                node.endsFunction = companion.(*FunctionDeclarationNode)
+                node.result, _ = node.GetScope().resolveSlot(node.endsFunction.Result.Name)
+                return nil
+            }
+        case (*StructDefinitionNode), (*TryNode):
+            counter--
+            if counter == 0 {
                 return nil
             }
         case (*BlockEndNode):
@@ -293,11 +1129,16 @@ func (node *BlockEndNode) Init(nodes []INode) error {
 
 func (node *BlockEndNode) Execute(state *XiiState) error {
     if node.companionNode != nil {
-        state.NextNode = node.companionNode
+        return node.companionNode.Continue(state)
     }
 
-    if node.endsFunction {
-        state.NextNode = state.FunctionStack.Pop().Next()
+    if node.endsFunction != nil {
+        var result interface{}
+        if node.endsFunction.Result.Name != "" {
+            result = state.ScopeOf(node).load(node.result)
+        }
+
+        returnFromFunction(state, result)
     }
 
     return nil
@@ -306,7 +1147,13 @@ func (node *BlockEndNode) Execute(state *XiiState) error {
 
 type SetNode struct {
     Node
+    // Target is the text in front of the "=", e.g. x, xs[i] or p.x
+    Target string
+    path []pathElement
     expression *Expression
+    // variable locates the variable named by Keyword
+    variable variableSlot
+    declared bool
 }
 
 func (node *SetNode) Init(nodes []INode) error {
@@ -314,7 +1161,23 @@ func (node *SetNode) Init(nodes []INode) error {
         return errors.New("set: Invalid set syntax")
     }
 
-    exp, err := NewExpression(node.Parameter[1:])
+    node.variable, node.declared = node.GetScope().resolveSlot(node.Keyword)
+
+    for _, element := range node.path {
+        if element.index != nil {
+            err := element.index.resolve(node.GetScope())
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    if t, _ := node.GetScope().staticType(node.Keyword); t == "string" && len(node.path) == 0 {
+        // Strings are set by concatenating the parameters, see run
+        return nil
+    }
+
+    exp, err := NewExpression(node.Parameter[1:], node.GetScope())
 
     if err != nil {
         return err
@@ -326,40 +1189,187 @@ func (node *SetNode) Init(nodes []INode) error {
 }
 
 func (node *SetNode) Execute(state *XiiState) error {
-    varname := node.Keyword
-    variable := node.GetScope().GetVar(varname)
-    _, ok := variable.(float64)
+    return node.run(state, state.ScopeOf(node))
+}
 
-    if !ok {
-        _, ok = variable.(string)
-        if !ok {
-            return errors.New("set: Can't set not existing variable")
-        }
+func (node *SetNode) run(state *XiiState, scope Variables) error {
+    if !node.declared {
+        return errors.New("set: Can't set not existing variable")
+    }
 
-        var setval string
-        for i, v := range node.Parameter {
-            if i > 0 {
-                setval += " "
-            }
-            setval += v.GetText(node.GetScope())
-        }
+    variable := scope.load(node.variable)
 
-        node.GetScope().SetVar(varname, setval)
+    if len(node.path) > 0 {
+        return node.setPath(state, scope, variable)
+    }
 
+    if _, ok := variable.(string); ok {
+        scope.store(node.variable, concatParameters(node.Parameter[1:], scope))
         return nil
     }
-    
-    res, err := Evaluate(node, node.expression)
+
+    res, err := EvaluateValue(state, scope, node.expression)
+
+    if err != nil {
+        return err
+    }
+
+    res, err = node.convert(variable, res)
 
     if err != nil {
         return err
     }
 
-    node.GetScope().SetVar(varname, res)
+    scope.store(node.variable, res)
+
+    return nil
+}
+
+// convert prepares the value of the expression to be stored in the variable
+// currently holding variable. Numbers are set like conditions are evaluated,
+// all other types have to match.
+func (node *SetNode) convert(variable interface{}, res interface{}) (interface{}, error) {
+    if _, ok := variable.(float64); ok {
+        return numberValue(res)
+    }
+
+    res, err := convertValue(res, typeOf(variable))
+
+    if err != nil {
+        return nil, err
+    }
+
+    if typeOf(res) != typeOf(variable) {
+        return nil, errors.New("set: Can't assign " + typeOf(res) + " to " + typeOf(variable) + " variable " + node.Keyword)
+    }
+
+    return res, nil
+}
+
+// setPath follows the indices and fields of the target and assigns to the last one
+func (node *SetNode) setPath(state *XiiState, scope Variables, container interface{}) error {
+    for i, element := range node.path {
+        last := i == len(node.path) - 1
+
+        if element.index == nil {
+            if last {
+                setter, ok := container.(FieldSetter)
+                if !ok {
+                    return errors.New("set: " + typeOf(container) + " has no fields")
+                }
+
+                res, err := EvaluateValue(state, scope, node.expression)
+                if err != nil {
+                    return err
+                }
+
+                return setter.SetField(element.field, res)
+            }
+
+            accessible, ok := container.(Accessible)
+            if !ok {
+                return errors.New("set: " + typeOf(container) + " has no fields")
+            }
+
+            var err error
+            container, err = accessible.Field(element.field)
+            if err != nil {
+                return err
+            }
+
+            continue
+        }
+
+        key, err := EvaluateValue(state, scope, element.index)
+        if err != nil {
+            return err
+        }
+
+        if !last {
+            indexable, ok := container.(Indexable)
+            if !ok {
+                return errors.New("set: " + typeOf(container) + " can't be indexed")
+            }
+
+            container, err = indexable.Index(key)
+            if err != nil {
+                return err
+            }
+
+            continue
+        }
+
+        setter, ok := container.(IndexSetter)
+        if !ok {
+            return errors.New("set: " + typeOf(container) + " can't be indexed")
+        }
+
+        res, err := EvaluateValue(state, scope, node.expression)
+        if err != nil {
+            return err
+        }
+
+        return setter.SetIndex(key, res)
+    }
 
     return nil
 }
 
+// pathElement is one step of an assignment target, either an index or a field
+type pathElement struct {
+    index *Expression
+    field string
+}
+
+// parseTargetPath splits an assignment target like xs[i][j + 1] or ps[0].x
+// into the variable name and the indices and fields following it.
+func parseTargetPath(target []Token) (string, []pathElement, error) {
+    text := joinWords(target).Text
+    if len(target) == 1 || target[0].Kind != TokenIdentifier || (target[1].Text != "[" && target[1].Text != ".") {
+        return text, nil, nil
+    }
+
+    var path []pathElement
+
+    p := newExprParser(target)
+    p.position = 1
+    for !p.done() {
+        operator, ok := p.acceptOperator("[", ".")
+        if !ok {
+            return "", nil, p.errorAt(p.peek(), "set: Invalid assignment target " + text)
+        }
+
+        if operator == "." {
+            field := p.next()
+            if field.Kind != TokenIdentifier {
+                return "", nil, p.errorAt(field, "set: Missing field name in " + text)
+            }
+
+            path = append(path, pathElement{field: field.Text})
+            continue
+        }
+
+        start := p.position
+        key, err := p.parseOr()
+        if err != nil {
+            return "", nil, err
+        }
+
+        if _, ok := p.acceptOperator("]"); !ok {
+            if !p.done() {
+                return "", nil, p.unexpected(p.peek())
+            }
+            return "", nil, p.errorAt(p.peek(), "set: Unbalanced brackets in " + text)
+        }
+
+        // Resolved by SetNode.Init, once all variables are declared
+        index := &Expression{Root: key, ExprString: joinWords(p.tokens[start:p.position - 1]).Text}
+        path = append(path, pathElement{index: index})
+    }
+
+    return target[0].Text, path, nil
+}
+
 
 func (node *Node) Execute(state *XiiState) error {
     return errors.New("No-Op Node executed")
@@ -373,6 +1383,11 @@ func (node *Node) Next() INode {
     return node.NextNode
 }
 
+func (node *Node) setLinks(previous, next INode) {
+    node.PreviousNode = previous
+    node.NextNode = next
+}
+
 func (node *Node) GetKeyword() string {
     return node.Keyword
 }
@@ -381,6 +1396,10 @@ func (node *Node) GetID() int {
     return node.ID
 }
 
+func (node *Node) setID(id int) {
+    node.ID = id
+}
+
 func (node *Node) Init(nodes []INode) error {
     return nil
 }
@@ -393,39 +1412,76 @@ func (node *Node) GetTrace() string {
     return node.Trace
 }
 
+func (node *Node) GetPosition() Token {
+    return node.Position
+}
+
+func (node *Node) setPosition(token Token) {
+    node.Position = token
+}
+
+func (node *Node) parameters() []IParameter {
+    return node.Parameter
+}
+
 func (node *Node) GetScope() *Scope {
     return node.Scope
 }
 
 func findNextEndNode(node INode) INode {
-    nextEnd := node.Next()
+    next := node.Next()
     counter := 1
-    _, ok := nextEnd.(*BlockEndNode)
-    for {
-        if ok {
+    for next != nil {
+        if _, ok := next.(*BlockEndNode); ok {
             counter--
-
             if counter == 0 {
-                break
+                return next
             }
+        } else if opensBlock(next) {
+            counter++
         }
 
-        _, ok2 := nextEnd.(*LoopNode)
-        _, ok3 := nextEnd.(*ConditionNode)
-        _, ok4 := nextEnd.(*FunctionDeclarationNode)
+        next = next.Next()
+    }
 
-        if ok2 || ok3 || ok4 {
-            counter++
-        }
-        
-        nextEnd = nextEnd.Next()
+    return nil
+}
 
-        if nextEnd == nil {
-            return nil
+
+// findNextBranchNode returns the next else, elseif or end node on the same
+// block level as node.
+func findNextBranchNode(node INode) INode {
+    next := node.Next()
+    counter := 1
+    for next != nil {
+        switch next.(type) {
+        case *BlockEndNode:
+            counter--
+            if counter == 0 {
+                return next
+            }
+        case *ElseNode:
+            if counter == 1 {
+                return next
+            }
+        default:
+            if opensBlock(next) {
+                counter++
+            }
         }
 
-        _, ok = nextEnd.(*BlockEndNode)
+        next = next.Next()
+    }
+
+    return nil
+}
+
+// opensBlock reports whether node has to be closed by an end node
+func opensBlock(node INode) bool {
+    switch node.(type) {
+    case *LoopNode, *ForNode, *ForEachNode, *ConditionNode, *FunctionDeclarationNode, *StructDefinitionNode, *TryNode:
+        return true
     }
 
-    return nextEnd
+    return false
 }
@@ -0,0 +1,238 @@
+package interpreter
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Optimize is an optional pass over the nodes returned by ParseTokens. It
+// folds the constant parts of expressions, removes if blocks whose condition
+// is always false and drops declarations, which only matter while parsing.
+// The remaining nodes are linked and initialized again.
+func Optimize(nodes []INode) ([]INode, error) {
+    foldNodes(nodes)
+
+    var kept []INode
+    for i := 0; i < len(nodes); i++ {
+        switch node := nodes[i].(type) {
+        case *NumberDeclarationNode, *LiteralDeclarationNode, *IntDeclarationNode, *BoolDeclarationNode, *ListDeclarationNode, *MapDeclarationNode, *StructDeclarationNode, *ImportNode:
+            // The variables and modules are declared in their scope by ParseTokens
+            continue
+        case *ConditionNode:
+            if _, ok := node.nextBranch.(*BlockEndNode); ok && isConstantFalse(node.expression) {
+                i = node.nextBranch.GetID()
+                continue
+            }
+        }
+
+        kept = append(kept, nodes[i])
+    }
+
+    if len(kept) == len(nodes) {
+        return nodes, nil
+    }
+
+    if len(kept) == 0 {
+        // Scripts that only declare variables still need a node to start at
+        return nodes, nil
+    }
+
+    for i, node := range kept {
+        var previous, next INode
+        if i > 0 {
+            previous = kept[i - 1]
+        }
+        if i < len(kept) - 1 {
+            next = kept[i + 1]
+        }
+
+        node.(numberedNode).setID(i)
+        node.(linkedNode).setLinks(previous, next)
+    }
+
+    // Init finds the blocks again and recreates the expressions of the nodes
+    for _, node := range kept {
+        err := node.Init(kept)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %s", node.GetTrace(), err.Error())
+        }
+    }
+
+    foldNodes(kept)
+
+    return kept, nil
+}
+
+// isConstantFalse reports whether an expression always evaluates to false or 0
+func isConstantFalse(expression *Expression) bool {
+    literal, ok := expression.Root.(*literalExpr)
+    if !ok {
+        return false
+    }
+
+    switch v := literal.value.(type) {
+    case bool:
+        return !v
+    case float64:
+        return v == 0
+    case int64:
+        return v == 0
+    }
+
+    return false
+}
+
+// foldNodes folds the expressions of all nodes, including the ones of their parameters
+func foldNodes(nodes []INode) {
+    for _, node := range nodes {
+        for _, expression := range nodeExpressions(node) {
+            expression.Root = foldConstants(expression.Root)
+        }
+    }
+}
+
+// nodeExpressions returns the expressions a node evaluates
+func nodeExpressions(node INode) []*Expression {
+    var expressions []*Expression
+
+    switch n := node.(type) {
+    case *DeleteNode:
+        expressions = append(expressions, n.target, n.key)
+    case *AppendNode:
+        expressions = append(expressions, n.list, n.expression)
+    case *ReturnNode:
+        expressions = append(expressions, n.expression)
+    case *LoopNode:
+        expressions = append(expressions, n.expression)
+    case *ForNode:
+        expressions = append(expressions, n.start, n.limit, n.step)
+    case *ForEachNode:
+        expressions = append(expressions, n.expression)
+    case *ConditionNode:
+        expressions = append(expressions, n.expression)
+    case *ElseNode:
+        expressions = append(expressions, n.expression)
+    case *SetNode:
+        expressions = append(expressions, n.expression)
+        for _, element := range n.path {
+            expressions = append(expressions, element.index)
+        }
+    }
+
+    // Optional expressions are nil if they are missing
+    present := expressions[:0]
+    for _, expression := range expressions {
+        if expression != nil {
+            present = append(present, expression)
+        }
+    }
+
+    if len(present) > 0 {
+        return present
+    }
+
+    // The expressions above are parsed from all parameters of the node, other
+    // nodes like out evaluate their expression parameters one by one
+    for _, p := range node.(parameterizedNode).parameters() {
+        if exp, ok := p.(*ExpressionParameter); ok {
+            present = append(present, exp.expression)
+        }
+    }
+
+    return present
+}
+
+// foldConstants replaces the operations and calls in e that only depend on
+// literals by their result. Operations that fail are left alone, so the
+// error is still reported when the node executes.
+func foldConstants(e exprNode) exprNode {
+    switch n := e.(type) {
+    case *unaryExpr:
+        n.operand = foldConstants(n.operand)
+        if isLiteral(n.operand) {
+            return evalConstant(n)
+        }
+    case *binaryExpr:
+        n.left = foldConstants(n.left)
+        n.right = foldConstants(n.right)
+        if isLiteral(n.left) && isLiteral(n.right) {
+            return evalConstant(n)
+        }
+    case *logicalExpr:
+        n.left = foldConstants(n.left)
+        n.right = foldConstants(n.right)
+        if isLiteral(n.left) && isLiteral(n.right) {
+            return evalConstant(n)
+        }
+    case *callExpr:
+        constant := true
+        for i, argument := range n.arguments {
+            n.arguments[i] = foldConstants(argument)
+            constant = constant && isLiteral(n.arguments[i])
+        }
+        if constant {
+            return evalConstant(n)
+        }
+    case *indexExpr:
+        n.target = foldConstants(n.target)
+        n.key = foldConstants(n.key)
+    case *fieldExpr:
+        n.target = foldConstants(n.target)
+    }
+
+    return e
+}
+
+func isLiteral(e exprNode) bool {
+    _, ok := e.(*literalExpr)
+    return ok
+}
+
+// evalConstant evaluates an expression made of literals, it doesn't need any variables
+func evalConstant(e exprNode) exprNode {
+    value, err := e.eval(nil)
+    if err != nil {
+        return e
+    }
+
+    switch value.(type) {
+    case float64, int64, string, bool:
+        return &literalExpr{value: value}
+    }
+
+    return e
+}
+
+// FormatNodes lists the nodes one per line, together with their expressions
+// as they are evaluated, e.g.
+//
+//     3  line 5: x = 2 * 3 + y  =>  (6 + y)
+func FormatNodes(nodes []INode) string {
+    lines := make([]string, len(nodes))
+    for i, node := range nodes {
+        parameters := node.(parameterizedNode).parameters()
+        source := make([]string, 0, len(parameters) + 1)
+        source = append(source, node.GetKeyword())
+        if set, ok := node.(*SetNode); ok {
+            source[0] = set.Target
+        }
+        for _, p := range parameters {
+            source = append(source, p.GetRaw())
+        }
+
+        line := fmt.Sprintf("%4d  line %d: %s", node.GetID(), node.GetPosition().Line, strings.Join(source, " "))
+
+        expressions := nodeExpressions(node)
+        if len(expressions) > 0 {
+            formatted := make([]string, len(expressions))
+            for j, expression := range expressions {
+                formatted[j] = expression.Root.String()
+            }
+            line += "  =>  " + strings.Join(formatted, ", ")
+        }
+
+        lines[i] = line
+    }
+
+    return strings.Join(lines, "\n")
+}
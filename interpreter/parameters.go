@@ -1,24 +1,27 @@
 package interpreter
 
 import (
-	"strings"
     "strconv"
-
-    humanize "github.com/dustin/go-humanize"
 )
 
 type Parameter struct {
     Text string
+    // tokens are the tokens the parameter was read from, expressions are
+    // parsed from them
+    tokens []Token
 }
 
 type IParameter interface {
-    GetText(scope *Scope) string
+    GetText(scope Variables) string
     GetRaw() string
-    GetValue(scope *Scope) interface{}
+    GetValue(scope Variables) interface{}
 }
 
 type LiteralParameter struct {
     Parameter
+    // value is the content of the literal, without quotes and with escape
+    // sequences replaced
+    value string
 }
 
 func (p LiteralParameter) String() string {
@@ -33,61 +36,148 @@ func (p NumberParameter) String() string {
     return "*" + p.Text + "*"
 }
 
-func (p NumberParameter) GetValue(_ *Scope) interface{} {
+func (p NumberParameter) GetValue(_ Variables) interface{} {
+    // Like in expressions, whole numbers too large for a float stay ints
+    integer, err := strconv.ParseInt(p.Text, 10, 64)
+    if err == nil && (integer > 1 << 53 || integer < -(1 << 53)) {
+        return integer
+    }
+
     retval, _ := strconv.ParseFloat(p.Text, 64)
     return retval
 }
 
+type BoolParameter struct {
+    Parameter
+}
+
+func (p BoolParameter) String() string {
+    return "?" + p.Text + "?"
+}
+
+func (p BoolParameter) GetValue(_ Variables) interface{} {
+    return p.Text == "true"
+}
+
 type VariableParameter struct {
     Parameter
+    // slot locates the variable, if resolve found a declaration for it
+    slot variableSlot
+    resolved bool
 }
 
 func (p VariableParameter) String() string {
     return "%" + p.Text + "%"
 }
 
-func (p VariableParameter) GetText(scope *Scope) string {
-    variable := scope.GetVar(p.Text)
+// resolve looks up the declaration of the variable, a name that isn't
+// declared evaluates to an empty string
+func (p *VariableParameter) resolve(scope *Scope) error {
+    p.slot, p.resolved = scope.resolveSlot(p.Text)
+    return nil
+}
 
-    if variable == nil {
-        return ""
+func (p VariableParameter) variable(scope Variables) interface{} {
+    if !p.resolved {
+        return nil
     }
 
-    lit, ok1 := variable.(string)
-    num, ok2 := variable.(float64)
+    return scope.load(p.slot)
+}
+
+func (p VariableParameter) GetText(scope Variables) string {
+    variable := p.variable(scope)
 
-    if ok1 {
-        return strings.Replace(lit, "\"", "", -1)
+    if variable == nil {
+        return ""
     }
-    if ok2 {
-        return humanize.Ftoa(num)
+
+    if lit, ok := variable.(string); ok {
+        return lit
     }
 
-    return ""
+    return formatValue(variable)
 }
 
-func (p VariableParameter) GetValue(scope *Scope) interface{} {
-    variable := scope.GetVar(p.Text)
+func (p VariableParameter) GetValue(scope Variables) interface{} {
+    variable := p.variable(scope)
 
     if variable == nil {
         return ""
     }
 
-    lit, ok1 := variable.(string)
-    num, ok2 := variable.(float64)
+    return variable
+}
 
-    if ok1 {
-        return strings.Replace(lit, "\"", "", -1)
+// ExpressionParameter is a single parameter that has to be evaluated, like
+// xs[i] or len(xs)
+type ExpressionParameter struct {
+    Parameter
+    expression *Expression
+}
+
+func NewExpressionParameter(text string) (*ExpressionParameter, error) {
+    tokens, err := scanExpression(text)
+    if err != nil {
+        return nil, err
     }
-    if ok2 {
-        return num
+
+    return newExpressionParameter(tokens)
+}
+
+func newExpressionParameter(word []Token) (*ExpressionParameter, error) {
+    exp, err := parseExpressionFromTokens(word)
+    if err != nil {
+        return nil, err
+    }
+
+    return &ExpressionParameter{Parameter: Parameter{Text: exp.ExprString, tokens: word}, expression: exp}, nil
+}
+
+func (p ExpressionParameter) String() string {
+    return "$" + p.Text + "$"
+}
+
+// resolve resolves the variables of the expression, the scope is not
+// complete yet when parameters are parsed
+func (p *ExpressionParameter) resolve(scope *Scope) error {
+    return p.expression.resolve(scope)
+}
+
+func (p ExpressionParameter) Evaluate(state *XiiState, scope Variables) (interface{}, error) {
+    return EvaluateValue(state, scope, p.expression)
+}
+
+func (p ExpressionParameter) GetText(scope Variables) string {
+    return formatValue(p.GetValue(scope))
+}
+
+func (p ExpressionParameter) GetValue(scope Variables) interface{} {
+    value, err := p.Evaluate(nil, scope)
+    if err != nil {
+        return nil
     }
 
-    return ""
+    return value
 }
 
-func (l LiteralParameter) GetText(scope *Scope) string {
-    return strings.Replace(l.Text, "\"", "", -1)
+// evaluateParameter returns the value of a parameter, reporting errors of
+// ExpressionParameters instead of swallowing them like GetValue does
+func evaluateParameter(state *XiiState, p IParameter, scope Variables) (interface{}, error) {
+    exp, ok := p.(*ExpressionParameter)
+    if ok {
+        return exp.Evaluate(state, scope)
+    }
+
+    return p.GetValue(scope), nil
+}
+
+func (l LiteralParameter) GetText(scope Variables) string {
+    return l.value
+}
+
+func (l LiteralParameter) GetValue(scope Variables) interface{} {
+    return l.value
 }
 
 type OperatorParameter struct {
@@ -99,7 +189,7 @@ func (p OperatorParameter) String() string {
     return "{" + p.Text + "}"
 }
 
-func (p Parameter) GetText(_ *Scope) string {
+func (p Parameter) GetText(_ Variables) string {
     return p.Text
 }
 
@@ -107,6 +197,10 @@ func (p Parameter) GetRaw() string {
     return p.Text
 }
 
-func (p Parameter) GetValue(scope *Scope) interface{} {
+func (p Parameter) sourceTokens() []Token {
+    return p.tokens
+}
+
+func (p Parameter) GetValue(scope Variables) interface{} {
     return p.GetText(scope)
 }
\ No newline at end of file
@@ -1,62 +1,274 @@
 package interpreter
 
 import (
+    "errors"
+    "strings"
 )
 
 type Scope struct {
     baseScope *Scope
-    variableTable map[string]interface{}
+    // variables holds the values of the variables declared in the scope,
+    // variableIndex maps their names to their position in variables
+    variables []interface{}
+    variableIndex map[string]int
     functionTable map[string]INode
+    structTable map[string]*StructType
+    // modules maps the names modules are imported as to their top level scopes
+    modules map[string]*Scope
+    // untyped marks variables whose type is only known at runtime, like the
+    // variables of foreach loops
+    untyped map[string]bool
+    // function is the function this scope is declared in, nil for global scopes
+    function *FunctionDeclarationNode
+    // index is the position of the scope in the scopes of function, the
+    // runtime instances of a call are stored at the same position
+    index int
+}
+
+// variableSlot is the location of a variable as resolved by resolveSlot: the
+// variable is stored at index in the scope depth levels above the scope it
+// is used in. Runtime instances of scopes are linked like the scopes created
+// by ParseTokens, so the same slot is valid in all of them.
+type variableSlot struct {
+    depth int
+    index int
+}
+
+// Variables gives nodes access to the variables visible where they execute.
+// It is implemented by Scope, and by the slots of the bytecode machine.
+type Variables interface {
+    GetVar(name string) interface{}
+    SetVar(name string, value interface{})
+    // load and store access a variable through its resolved slot
+    load(at variableSlot) interface{}
+    store(at variableSlot, value interface{})
 }
 
 var DummyScope = &Scope{}
 
 func NewScope(baseScope *Scope) *Scope {
-    return &Scope{variableTable: make(map[string]interface{}), functionTable: make(map[string]INode), baseScope: baseScope}
+    return newScope(baseScope, baseScope.function)
 }
 
-func (scope *Scope) SetVar(name string, value interface{}) {
-    if !scope.setIfExists(name, value) {
-        scope.variableTable[name] = value
+// newScope creates a scope declared in function, the function numbers the
+// scopes declared in it
+func newScope(baseScope *Scope, function *FunctionDeclarationNode) *Scope {
+    scope := &Scope{variableIndex: make(map[string]int), functionTable: make(map[string]INode), structTable: make(map[string]*StructType), modules: make(map[string]*Scope), baseScope: baseScope, function: function}
+
+    if function != nil {
+        scope.index = len(function.scopes)
+        function.scopes = append(function.scopes, scope)
     }
+
+    return scope
 }
 
-func (scope *Scope) setIfExists(name string, value interface{}) bool {
-    _, ok := scope.variableTable[name]
-    if ok {
-        scope.variableTable[name] = value
-        return true
+// instantiate creates a copy of the scope with its variables reset to their
+// declared values, used for the scopes of a new function invocation.
+func (scope *Scope) instantiate(baseScope *Scope) *Scope {
+    variables := make([]interface{}, len(scope.variables))
+    for i, v := range scope.variables {
+        variables[i] = freshValue(v)
     }
 
-    if scope.baseScope != nil {
-        return scope.baseScope.setIfExists(name, value)
+    return &Scope{variables: variables, variableIndex: scope.variableIndex, functionTable: scope.functionTable, structTable: scope.structTable, modules: scope.modules, baseScope: baseScope, function: scope.function, index: scope.index}
+}
+
+// snapshot copies the declarations and values of the scope, so they can be
+// reset by restore
+func (scope *Scope) snapshot() *Scope {
+    saved := *scope
+    saved.variables = append([]interface{}(nil), scope.variables...)
+
+    saved.variableIndex = make(map[string]int, len(scope.variableIndex))
+    for k, v := range scope.variableIndex {
+        saved.variableIndex[k] = v
+    }
+
+    saved.functionTable = make(map[string]INode, len(scope.functionTable))
+    for k, v := range scope.functionTable {
+        saved.functionTable[k] = v
+    }
+
+    saved.structTable = make(map[string]*StructType, len(scope.structTable))
+    for k, v := range scope.structTable {
+        saved.structTable[k] = v
+    }
+
+    saved.modules = make(map[string]*Scope, len(scope.modules))
+    for k, v := range scope.modules {
+        saved.modules[k] = v
+    }
+
+    saved.untyped = make(map[string]bool, len(scope.untyped))
+    for k, v := range scope.untyped {
+        saved.untyped[k] = v
+    }
+
+    return &saved
+}
+
+func (scope *Scope) restore(saved *Scope) {
+    *scope = *saved
+}
+
+// declare adds a variable to the scope, or resets its value if it has been
+// declared before with the same type
+func (scope *Scope) declare(name string, value interface{}) error {
+    if index, ok := scope.variableIndex[name]; ok {
+        // A variable can only be declared again with the same type
+        if previous := scope.variables[index]; previous != nil && value != nil && typeOf(previous) != typeOf(value) {
+            return errors.New("Variable " + name + " is already declared as " + typeOf(previous))
+        }
+
+        scope.variables[index] = value
+        return nil
+    }
+
+    scope.variableIndex[name] = len(scope.variables)
+    scope.variables = append(scope.variables, value)
+
+    return nil
+}
+
+// resolveSlot finds the declaration of a variable visible in scope
+func (scope *Scope) resolveSlot(name string) (variableSlot, bool) {
+    depth := 0
+    for s := scope; s != nil; s = s.baseScope {
+        if index, ok := s.variableIndex[name]; ok {
+            return variableSlot{depth: depth, index: index}, true
+        }
+        depth++
+    }
+
+    return variableSlot{}, false
+}
+
+func (scope *Scope) load(at variableSlot) interface{} {
+    s := scope
+    for i := 0; i < at.depth; i++ {
+        s = s.baseScope
+    }
+
+    return s.variables[at.index]
+}
+
+func (scope *Scope) store(at variableSlot, value interface{}) {
+    s := scope
+    for i := 0; i < at.depth; i++ {
+        s = s.baseScope
+    }
+
+    s.variables[at.index] = value
+}
+
+// SetVar assigns a new value to a variable visible in scope. If there is
+// none, the variable is created in scope.
+func (scope *Scope) SetVar(name string, value interface{}) {
+    if at, ok := scope.resolveSlot(name); ok {
+        scope.store(at, value)
+        return
+    }
+
+    // Runtime instances share the index with the scope they were created
+    // from, the variable must only be added to this one
+    variableIndex := make(map[string]int, len(scope.variableIndex) + 1)
+    for k, v := range scope.variableIndex {
+        variableIndex[k] = v
     }
+    scope.variableIndex = variableIndex
 
-    return false
+    scope.declare(name, value)
 }
 
+// GetVar returns the value of a variable visible in scope, nil if there is
+// none. Nodes access variables through the slots they resolved at parse
+// time, GetVar looks them up by name.
 func (scope *Scope) GetVar(name string) interface{} {
-    val, ok := scope.variableTable[name]
+    if at, ok := scope.resolveSlot(name); ok {
+        return scope.load(at)
+    }
+
+    return nil
+}
+
+func (scope *Scope) GetFunctionNode(name string) INode {
+    if dot := strings.Index(name, "."); dot > 0 {
+        // Functions of modules are called by the name the module is imported as, e.g. m.output
+        module := scope.getModule(name[:dot])
+        if module == nil {
+            return nil
+        }
+
+        return module.functionTable[name[dot + 1:]]
+    }
+
+    val, ok := scope.functionTable[name]
     if ok {
         return val
     }
 
     if scope.baseScope != nil {
-        return scope.baseScope.GetVar(name)
+        return scope.baseScope.GetFunctionNode(name)
     }
 
     return nil
 }
 
-func (scope *Scope) GetFunctionNode(name string) INode {
-    val, ok := scope.functionTable[name]
+// getModule returns the top level scope of the module imported as name
+func (scope *Scope) getModule(name string) *Scope {
+    for s := scope; s != nil; s = s.baseScope {
+        if module, ok := s.modules[name]; ok {
+            return module
+        }
+    }
+
+    return nil
+}
+
+func (scope *Scope) GetStructType(name string) *StructType {
+    val, ok := scope.structTable[name]
     if ok {
         return val
     }
 
     if scope.baseScope != nil {
-        return scope.baseScope.GetFunctionNode(name)
+        return scope.baseScope.GetStructType(name)
     }
 
     return nil
-}
\ No newline at end of file
+}
+
+// staticType returns the declared type of a variable visible in scope and
+// whether it is declared at all. The type is empty for untyped variables.
+func (scope *Scope) staticType(name string) (string, bool) {
+    for s := scope; s != nil; s = s.baseScope {
+        index, ok := s.variableIndex[name]
+        if !ok {
+            continue
+        }
+
+        if s.untyped[name] {
+            return "", true
+        }
+
+        return typeOf(s.variables[index]), true
+    }
+
+    return "", false
+}
+
+// isType reports whether t is a builtin type or a struct declared in scope
+func (scope *Scope) isType(t string) bool {
+    return isTypeName(t) || scope.GetStructType(t) != nil
+}
+
+// zeroValue is like the package level zeroValue, but also knows the structs
+// declared in scope
+func (scope *Scope) zeroValue(t string) interface{} {
+    if st := scope.GetStructType(t); st != nil {
+        return st.New()
+    }
+
+    return zeroValue(t)
+}
@@ -0,0 +1,192 @@
+package interpreter
+
+import (
+    "bufio"
+    "context"
+    "io"
+    "log"
+    "sort"
+    "strings"
+)
+
+// Session runs XiiLang code piece by piece, like the interactive mode of
+// xii. Variables, functions and structs declared by one piece stay visible
+// to the following ones, and the global variables keep their values.
+type Session struct {
+    // ModulePath lists the directories imports are searched in, see VM.ModulePath
+    ModulePath []string
+    // Logger receives progress messages, see VM.Logger
+    Logger *log.Logger
+    // VerboseEval traces every evaluated expression to stderr
+    VerboseEval bool
+
+    scope *Scope
+    state *XiiState
+    // nodes holds the nodes of all pieces run so far. They are numbered in
+    // sequence, so try blocks can be found across pieces.
+    nodes []INode
+}
+
+// NewSession creates an empty session. Passing a *bufio.Reader as stdin
+// allows the caller to keep reading lines from it between pieces.
+func NewSession(stdin io.Reader, stdout, stderr io.Writer) *Session {
+    state := &XiiState{}
+    state.FunctionStack = NewFrameStack()
+    state.StdOut = bufio.NewWriter(orDiscard(stdout))
+    state.StdIn = bufio.NewReader(stdin)
+    state.StdErr = orDiscard(stderr)
+
+    return &Session{ModulePath: DefaultModulePath(), Logger: discardLogger, scope: NewScope(DummyScope), state: state}
+}
+
+// Exec runs a piece of source, name is used in traces. If the source is a
+// single expression, like x * 2, it is evaluated instead and its value is
+// returned with ok set.
+func (session *Session) Exec(ctx context.Context, name string, source string) (value interface{}, ok bool, err error) {
+    tokens, err := tokenize(name, strings.NewReader(source), orDiscardLogger(session.Logger))
+    if err != nil {
+        return nil, false, err
+    }
+
+    if len(tokens) == 1 {
+        if expression, err := newExpressionFromTokens(tokens[0], session.scope); err == nil {
+            session.state.VerboseEval = session.VerboseEval
+            value, err := EvaluateValue(session.state, session.scope, expression)
+            if err != nil {
+                return nil, false, err
+            }
+
+            return value, true, nil
+        }
+    }
+
+    return nil, false, session.run(ctx, tokens)
+}
+
+// Load runs the script at path
+func (session *Session) Load(ctx context.Context, path string) error {
+    tokens, err := tokenizeFile(path, orDiscardLogger(session.Logger))
+    if err != nil {
+        return err
+    }
+
+    return session.run(ctx, tokens)
+}
+
+func (session *Session) run(ctx context.Context, tokens [][]Token) error {
+    // Declarations of pieces that fail to compile are undone
+    saved := session.scope.snapshot()
+
+    logger := orDiscardLogger(session.Logger)
+
+    nodes, err := parseTokens(tokens, session.scope, session.ModulePath, logger)
+    if err == nil {
+        err = CheckTypes(nodes)
+    }
+    if err != nil {
+        session.scope.restore(saved)
+        return err
+    }
+
+    for i, node := range nodes {
+        node.(numberedNode).setID(len(session.nodes) + i)
+    }
+    session.nodes = append(session.nodes, nodes...)
+
+    state := session.state
+    state.Nodes = session.nodes
+    state.NextNode = nodes[0]
+    state.Logger = logger
+    state.VerboseEval = session.VerboseEval
+
+    err = InterpretRelease(ctx, nodes, state)
+
+    // A failing piece can leave calls behind
+    state.FunctionStack = NewFrameStack()
+
+    flushErr := state.StdOut.Flush()
+    if err == nil {
+        err = flushErr
+    }
+
+    logger.Printf("Session: %d nodes run so far\n", len(session.nodes))
+
+    return err
+}
+
+// Complete reports whether all blocks opened in source have been closed and
+// its last statement doesn't continue on the next line, so it can be run
+func (session *Session) Complete(source string) bool {
+    if continuesStatement(source) {
+        return false
+    }
+
+    depth := 0
+    for _, line := range strings.Split(source, "\n") {
+        words := strings.Fields(line)
+        if len(words) == 0 {
+            continue
+        }
+
+        switch words[0] {
+        case "if", "while", "for", "foreach", "function", "struct", "try":
+            depth++
+        case "end":
+            depth--
+        }
+    }
+
+    return depth <= 0
+}
+
+// Vars describes the global variables, one per line sorted by name, e.g.
+// number x = 5
+func (session *Session) Vars() []string {
+    var names []string
+    for name := range session.scope.variableIndex {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    lines := make([]string, len(names))
+    for i, name := range names {
+        value := session.scope.GetVar(name)
+        lines[i] = typeOf(value) + " " + name + " = " + formatElement(value)
+    }
+
+    return lines
+}
+
+// Funcs describes the functions declared so far, one per line sorted by name
+// and formatted like their declaration, e.g. function number r add number a number b
+func (session *Session) Funcs() []string {
+    var names []string
+    for name := range session.scope.functionTable {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    lines := make([]string, len(names))
+    for i, name := range names {
+        fn := session.scope.functionTable[name].(*FunctionDeclarationNode)
+
+        words := []string{"function"}
+        if fn.Result.Name != "" {
+            words = append(words, fn.Result.Type, fn.Result.Name)
+        }
+        words = append(words, fn.Name)
+        for _, passer := range fn.Parameters {
+            words = append(words, passer.Type, passer.Name)
+        }
+
+        lines[i] = strings.Join(words, " ")
+    }
+
+    return lines
+}
+
+// FormatResult formats a value returned by Exec like it is written in
+// XiiLang, strings are quoted
+func FormatResult(value interface{}) string {
+    return formatElement(value)
+}
@@ -46,4 +46,46 @@ func (s *NodeStack) Pop() INode {
 
 func (s *NodeStack) Top() INode {
     return s.nodes[s.count - 1]
-}
\ No newline at end of file
+}
+
+func (s *NodeStack) Len() int {
+    return s.count
+}
+
+// Peek returns the node depth entries below the top, Peek(0) equals Top()
+func (s *NodeStack) Peek(depth int) INode {
+    return s.nodes[s.count - 1 - depth]
+}
+
+
+func NewFrameStack() *FrameStack {
+	return &FrameStack{}
+}
+
+type FrameStack struct {
+	frames []*Frame
+	count int
+}
+
+func (s *FrameStack) Push(f *Frame) {
+	s.frames = append(s.frames[:s.count], f)
+	s.count++
+}
+
+func (s *FrameStack) Pop() *Frame {
+	s.count--
+	return s.frames[s.count]
+}
+
+func (s *FrameStack) Top() *Frame {
+    return s.frames[s.count - 1]
+}
+
+func (s *FrameStack) Len() int {
+    return s.count
+}
+
+// Peek returns the frame depth entries below the top, Peek(0) equals Top()
+func (s *FrameStack) Peek(depth int) *Frame {
+    return s.frames[s.count - 1 - depth]
+}
@@ -2,12 +2,23 @@ package interpreter
 
 import (
     "bufio"
+    "io"
+    "log"
+    "time"
 )
 
 type XiiState struct {
     NextNode INode
     Nodes []INode
-    FunctionStack *NodeStack
-    PassingArea map[string]interface{}
+    FunctionStack *FrameStack
     StdOut *bufio.Writer
+    StdIn *bufio.Reader
+    StdErr io.Writer
+    // Logger receives progress messages, they are discarded if it is nil
+    Logger *log.Logger
+    // VerboseEval traces every evaluated expression to StdErr
+    VerboseEval bool
+    // ExecutionTimes collects the durations of the executed statements by
+    // keyword, it is only filled by InterpretDebug with time set
+    ExecutionTimes map[string][]time.Duration
 }
\ No newline at end of file
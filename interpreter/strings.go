@@ -0,0 +1,226 @@
+package interpreter
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "strings"
+    "unicode/utf8"
+)
+
+// builtinSubstr returns the part of a string from start to its end, or of the
+// given length. Like len, positions count characters, not bytes.
+func builtinSubstr(arguments ...interface{}) (interface{}, error) {
+    if len(arguments) != 2 && len(arguments) != 3 {
+        return nil, errors.New("substr() takes a string, a start and optionally a length as parameters")
+    }
+
+    s, err := stringArgument("substr", arguments[0])
+    if err != nil {
+        return nil, err
+    }
+
+    start, err := wholeArgument("substr", arguments[1])
+    if err != nil {
+        return nil, err
+    }
+
+    runes := []rune(s)
+    end := len(runes)
+    if len(arguments) == 3 {
+        length, err := wholeArgument("substr", arguments[2])
+        if err != nil {
+            return nil, err
+        }
+        if length < 0 {
+            return nil, fmt.Errorf("substr() length %d is negative", length)
+        }
+        end = start + length
+    }
+
+    if start < 0 || start > len(runes) || end > len(runes) {
+        return nil, fmt.Errorf("substr() range %d to %d out of range (length %d)", start, end, len(runes))
+    }
+
+    return string(runes[start:end]), nil
+}
+
+// builtinIndexOf returns the position of the first occurrence of a string, -1 if there is none
+func builtinIndexOf(arguments ...interface{}) (interface{}, error) {
+    s, sub, err := twoStrings("indexOf", arguments)
+    if err != nil {
+        return nil, err
+    }
+
+    i := strings.Index(s, sub)
+    if i < 0 {
+        return int64(-1), nil
+    }
+
+    return int64(utf8.RuneCountInString(s[:i])), nil
+}
+
+func builtinStartsWith(arguments ...interface{}) (interface{}, error) {
+    s, prefix, err := twoStrings("startsWith", arguments)
+    if err != nil {
+        return nil, err
+    }
+
+    return strings.HasPrefix(s, prefix), nil
+}
+
+// builtinSplit returns a list of the parts of a string between the
+// separators, an empty separator splits it into its characters
+func builtinSplit(arguments ...interface{}) (interface{}, error) {
+    s, separator, err := twoStrings("split", arguments)
+    if err != nil {
+        return nil, err
+    }
+
+    list := NewList()
+    for _, part := range strings.Split(s, separator) {
+        list.Append(part)
+    }
+
+    return list, nil
+}
+
+// builtinJoin concatenates the elements of a list, with a separator between them
+func builtinJoin(arguments ...interface{}) (interface{}, error) {
+    if len(arguments) != 2 {
+        return nil, errors.New("join() takes a list and a separator as parameters")
+    }
+
+    list, ok := arguments[0].(*List)
+    if !ok {
+        return nil, fmt.Errorf("join() can't be used on %s", typeOf(arguments[0]))
+    }
+
+    separator, err := stringArgument("join", arguments[1])
+    if err != nil {
+        return nil, err
+    }
+
+    // The list is being formatted, it is a placeholder if it contains itself
+    outer := []interface{}{list}
+    parts := make([]string, list.Len())
+    for i, item := range list.Items {
+        parts[i] = formatNested(item, outer)
+    }
+
+    return strings.Join(parts, separator), nil
+}
+
+// builtinReplace replaces all occurrences of a string
+func builtinReplace(arguments ...interface{}) (interface{}, error) {
+    if len(arguments) != 3 {
+        return nil, errors.New("replace() takes a string, the text to replace and its replacement as parameters")
+    }
+
+    var values [3]string
+    for i, argument := range arguments {
+        s, err := stringArgument("replace", argument)
+        if err != nil {
+            return nil, err
+        }
+        values[i] = s
+    }
+
+    return strings.Replace(values[0], values[1], values[2], -1), nil
+}
+
+func builtinUpper(arguments ...interface{}) (interface{}, error) {
+    return mapString("upper", arguments, strings.ToUpper)
+}
+
+func builtinLower(arguments ...interface{}) (interface{}, error) {
+    return mapString("lower", arguments, strings.ToLower)
+}
+
+// builtinTrim removes whitespace from the start and end of a string
+func builtinTrim(arguments ...interface{}) (interface{}, error) {
+    return mapString("trim", arguments, strings.TrimSpace)
+}
+
+// builtinFormat replaces the {} in its first parameter by the other
+// parameters in order, e.g. format("{} of {}", i, n)
+func builtinFormat(arguments ...interface{}) (interface{}, error) {
+    if len(arguments) < 1 {
+        return nil, errors.New("format() takes a format string and the values to insert as parameters")
+    }
+
+    format, err := stringArgument("format", arguments[0])
+    if err != nil {
+        return nil, err
+    }
+
+    values := arguments[1:]
+    if strings.Count(format, "{}") != len(values) {
+        return nil, fmt.Errorf("format() got %d values for %d placeholders", len(values), strings.Count(format, "{}"))
+    }
+
+    parts := strings.Split(format, "{}")
+    var formatted strings.Builder
+    for i, part := range parts {
+        formatted.WriteString(part)
+        if i < len(values) {
+            formatted.WriteString(formatValue(values[i]))
+        }
+    }
+
+    return formatted.String(), nil
+}
+
+func mapString(function string, arguments []interface{}, f func(string) string) (interface{}, error) {
+    if len(arguments) != 1 {
+        return nil, errors.New(function + "() takes exactly one parameter")
+    }
+
+    s, err := stringArgument(function, arguments[0])
+    if err != nil {
+        return nil, err
+    }
+
+    return f(s), nil
+}
+
+func twoStrings(function string, arguments []interface{}) (string, string, error) {
+    if len(arguments) != 2 {
+        return "", "", errors.New(function + "() takes two strings as parameters")
+    }
+
+    a, err := stringArgument(function, arguments[0])
+    if err != nil {
+        return "", "", err
+    }
+
+    b, err := stringArgument(function, arguments[1])
+    if err != nil {
+        return "", "", err
+    }
+
+    return a, b, nil
+}
+
+func stringArgument(function string, value interface{}) (string, error) {
+    s, ok := value.(string)
+    if !ok {
+        return "", fmt.Errorf("%s() can't be used on %s", function, typeOf(value))
+    }
+
+    return s, nil
+}
+
+// wholeArgument converts a position or length passed as a number or int
+func wholeArgument(function string, value interface{}) (int, error) {
+    if i, ok := value.(int64); ok {
+        value = float64(i)
+    }
+
+    n, ok := value.(float64)
+    if !ok || n != math.Trunc(n) || math.Abs(n) > math.MaxInt32 {
+        return 0, fmt.Errorf("%s() expects a whole number, got %s", function, formatElement(value))
+    }
+
+    return int(n), nil
+}
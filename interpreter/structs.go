@@ -0,0 +1,101 @@
+package interpreter
+
+import (
+    "errors"
+)
+
+// StructType is a type declared with a struct block
+type StructType struct {
+    Name string
+    Fields []StructField
+}
+
+type StructField struct {
+    Name string
+    Type string
+    // Struct is the declared type of fields holding structs, nil otherwise
+    Struct *StructType
+}
+
+func (t *StructType) Field(name string) *StructField {
+    for i := range t.Fields {
+        if t.Fields[i].Name == name {
+            return &t.Fields[i]
+        }
+    }
+
+    return nil
+}
+
+// New returns an instance of the struct with all fields set to their zero values
+func (t *StructType) New() *Struct {
+    s := &Struct{Type: t, Fields: make(map[string]interface{}, len(t.Fields))}
+
+    for _, field := range t.Fields {
+        if field.Struct != nil {
+            s.Fields[field.Name] = field.Struct.New()
+        } else {
+            s.Fields[field.Name] = zeroValue(field.Type)
+        }
+    }
+
+    return s
+}
+
+// Struct is the value of a struct variable. Like lists and maps, structs are
+// passed by reference.
+type Struct struct {
+    Type *StructType
+    Fields map[string]interface{}
+}
+
+// Field implements Accessible, so fields can be read in expressions
+func (s *Struct) Field(name string) (interface{}, error) {
+    value, ok := s.Fields[name]
+    if !ok {
+        return nil, errors.New(s.Type.Name + " has no field " + name)
+    }
+
+    return value, nil
+}
+
+func (s *Struct) SetField(name string, value interface{}) error {
+    field := s.Type.Field(name)
+    if field == nil {
+        return errors.New(s.Type.Name + " has no field " + name)
+    }
+
+    value, err := convertValue(value, field.Type)
+    if err != nil {
+        return err
+    }
+
+    if typeOf(value) != field.Type {
+        return errors.New("Can't assign " + typeOf(value) + " to " + field.Type + " field " + s.Type.Name + "." + name)
+    }
+
+    s.Fields[name] = value
+
+    return nil
+}
+
+func (s *Struct) String() string {
+    return formatValue(s)
+}
+
+func (s *Struct) format(outer []interface{}) string {
+    str := s.Type.Name + "{"
+    for i, field := range s.Type.Fields {
+        if i > 0 {
+            str += ", "
+        }
+        str += field.Name + ": " + formatNestedElement(s.Fields[field.Name], outer)
+    }
+
+    return str + "}"
+}
+
+// FieldSetter is implemented by values with fields that can be assigned to
+type FieldSetter interface {
+    SetField(name string, value interface{}) error
+}
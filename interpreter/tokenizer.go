@@ -2,113 +2,482 @@ package interpreter
 
 import (
     "bufio"
-    "os"
-    "log"
     "errors"
-    "strings"
-	"fmt"
+    "fmt"
+    "io"
+    "log"
+    "os"
     "path"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// TokenKind tells what a token is made of
+type TokenKind int
+
+const (
+    TokenIdentifier TokenKind = iota
+    TokenNumber
+    TokenString
+    TokenOperator
+    TokenComment
 )
 
+func (kind TokenKind) String() string {
+    switch kind {
+    case TokenIdentifier:
+        return "identifier"
+    case TokenNumber:
+        return "number"
+    case TokenString:
+        return "string"
+    case TokenOperator:
+        return "operator"
+    }
+
+    return "comment"
+}
+
 type Token struct {
+    Kind TokenKind
+    // Text is the token as written in the source, string literals include
+    // their quotes and escape sequences
     Text string
+    // Value is the content of a string literal, with its escape sequences replaced
+    Value string
     File string
     Line int
+    // Column is the position of the first character in the line, starting at 1
+    Column int
+    // Source is the line the token was read from
+    Source string
 }
 
-var (
-    currentTokenLine int
-    currentPath string
-)
+// operatorTokens lists the operators the scanner knows, longer ones first
+var operatorTokens = []string{
+    "->", "==", "!=", "<=", ">=", "<<", ">>", "&&", "||",
+    "+", "-", "*", "/", "%", "^", "&", "|", "~", "!", "<", ">", "=",
+    "(", ")", "[", "]", ",", ".",
+}
+
+// tokenizer collects the statements of a script and the files it parses
+type tokenizer struct {
+    lines [][]Token
+    diagnostics Diagnostics
+    // pending holds the tokens of a statement that continues on the next
+    // line, depth counts the brackets it leaves open
+    pending []Token
+    depth int
+    // parsing is a parse statement whose file name continues on the next
+    // line, target holds the name so far
+    parsing *Token
+    target string
+    // reading holds the files being read, the innermost last
+    reading []string
+    logger *log.Logger
+}
 
 func TokenizeFile(path string) ([][]Token, error) {
-    
+    return tokenizeFile(path, discardLogger)
+}
+
+// Tokenize reads XiiLang source from reader. The name is used for traces and
+// to resolve parse statements relative to it.
+func Tokenize(name string, reader io.Reader) ([][]Token, error) {
+    return tokenize(name, reader, discardLogger)
+}
+
+func tokenizeFile(path string, logger *log.Logger) ([][]Token, error) {
     inFile, err := os.Open(path)
     if err != nil {
         return nil, err
     }
     defer inFile.Close()
 
-    scanner := bufio.NewScanner(inFile)
-    scanner.Split(bufio.ScanLines)
+    return tokenize(path, inFile, logger)
+}
+
+func tokenize(name string, reader io.Reader, logger *log.Logger) ([][]Token, error) {
+    logger.Println("Tokenizing...")
 
-    var tokens [][]Token
+    t := &tokenizer{logger: logger}
+    err := t.read(name, reader)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(t.diagnostics) > 0 {
+        return nil, t.diagnostics
+    }
 
-    log.Println("Tokenizing...")
+    logger.Printf("%d lines processed\n", len(t.lines))
 
-    currentTokenLine = 0
-    currentPath = path
+    if len(t.lines) == 0 {
+        return nil, errors.New("No tokens found, is the file empty?")
+    }
 
+    return t.lines, nil
+}
+
+func (t *tokenizer) read(name string, reader io.Reader) error {
+    scanner := bufio.NewScanner(reader)
+    scanner.Split(bufio.ScanLines)
+
+    t.reading = append(t.reading, moduleKey(name))
+    defer func() { t.reading = t.reading[:len(t.reading) - 1] }()
+
+    number := 0
     for scanner.Scan() {
-        currentTokenLine++
-        tokenize(scanner.Text(), &tokens)
+        number++
+        t.tokenize(name, number, scanner.Text())
     }
 
-    log.Printf("%d lines processed\n", len(tokens))
+    if len(t.pending) > 0 {
+        t.diagnostics.add(t.pending[0], "Statement continues past the end of the file")
+        t.pending = nil
+        t.depth = 0
+    }
 
-    if len(tokens) == 0 {
-        return nil, errors.New("No tokens found, is the file empty?")
+    if t.parsing != nil {
+        t.diagnostics.add(*t.parsing, "Statement continues past the end of the file")
+        t.parsing = nil
     }
 
-    return tokens, nil
+    return scanner.Err()
 }
 
-func tokenize(line string, slice *[][]Token) {
-    trimmed := strings.TrimSpace(line)
-    if trimmed == "" {
+// tokenize adds the tokens of a line to the current statement. Statements
+// continue on the next line if the line ends with a \ or leaves brackets
+// open, the tokens keep the positions of the lines they are on.
+func (t *tokenizer) tokenize(name string, number int, line string) {
+    // The file name of a parse statement is taken as it is, only comments
+    // and continuations are removed
+    if t.parsing != nil {
+        t.continueParse(line)
         return
     }
 
-    if strings.Index(trimmed, "#") == 0 {
+    words := strings.Fields(removeComment(line))
+    if len(t.pending) == 0 && len(words) > 1 && words[0] == "parse" {
+        t.parsing = &Token{Kind: TokenIdentifier, Text: line, File: name, Line: number, Column: 1, Source: line}
+        t.target = ""
+        t.continueParse(strings.TrimSpace(line)[len(words[0]):])
         return
     }
 
-    words := strings.Split(line, " ")
+    tokens := scanLine(name, number, line, &t.diagnostics)
+
+    // Comments run to the end of the line
+    if len(tokens) > 0 && tokens[len(tokens) - 1].Kind == TokenComment {
+        tokens = tokens[:len(tokens) - 1]
+    }
+
+    continued := false
+    for i, token := range tokens {
+        if token.Kind != TokenOperator {
+            continue
+        }
 
-    if len(words) > 1 && words[0] == "parse" {
-        oldPath := currentPath
-        folderpath := path.Dir(oldPath)
-        if folderpath != string(os.PathSeparator) {
-            folderpath += string(os.PathSeparator)
+        switch token.Text {
+        case "\\":
+            if i < len(tokens) - 1 {
+                t.diagnostics.add(token, "\\ continues a statement on the next line, it has to end the line")
+                return
+            }
+            continued = true
+            tokens = tokens[:i]
+        case "(", "[":
+            t.depth++
+        case ")", "]":
+            if t.depth > 0 {
+                t.depth--
+            }
         }
-        currentPath = folderpath + strings.TrimLeft(line, words[0] + " ")
+    }
+
+    t.pending = append(t.pending, tokens...)
+
+    if continued || t.depth > 0 || len(t.pending) == 0 {
+        return
+    }
+
+    t.lines = append(t.lines, t.pending)
+    t.pending = nil
+}
+
+// continueParse adds a line to the file name of the current parse statement
+// and parses the file once the name is complete
+func (t *tokenizer) continueParse(line string) {
+    part := strings.TrimSpace(removeComment(line))
+
+    continued := strings.HasSuffix(part, "\\")
+    if continued {
+        part = strings.TrimSpace(strings.TrimSuffix(part, "\\"))
+    }
+
+    if t.target != "" && part != "" {
+        t.target += " "
+    }
+    t.target += part
+
+    if continued {
+        return
+    }
+
+    statement := *t.parsing
+    t.parsing = nil
+
+    if t.target == "" {
+        t.diagnostics.add(statement, "Invalid parse syntax, expected parse <filename>")
+        return
+    }
+
+    t.parse(statement, t.target)
+}
+
+// removeComment cuts off the comment at the end of a line without strings
+func removeComment(line string) string {
+    if i := strings.IndexRune(line, '#'); i >= 0 {
+        return line[:i]
+    }
+
+    return line
+}
 
-        log.Println("Parse expression found, loading external file \"" + currentPath + "\"...")
+// parse adds the lines of the file at target in place of the parse
+// statement, target is relative to the file containing the statement
+func (t *tokenizer) parse(statement Token, target string) {
+    folderpath := path.Dir(statement.File)
+    if folderpath != string(os.PathSeparator) {
+        folderpath += string(os.PathSeparator)
+    }
+    target = folderpath + target
 
-        inFile, err := os.Open(currentPath)
-        if err != nil {
-            fmt.Println("Couldn't open parse-file, ignoring for now, but don't be alarmed if errors happen later.")
-            currentPath = oldPath
+    for _, reading := range t.reading {
+        if reading == moduleKey(target) {
+            t.diagnostics.add(statement, "Can't parse " + target + ", it is already being parsed")
             return
         }
-        defer inFile.Close()
+    }
+
+    t.logger.Println("Parse expression found, loading external file \"" + target + "\"...")
+
+    inFile, err := os.Open(target)
+    if err != nil {
+        t.diagnostics.add(statement, "Can't parse " + target + ": " + err.Error())
+        return
+    }
+    defer inFile.Close()
+
+    err = t.read(target, inFile)
+    if err != nil {
+        t.diagnostics.add(statement, "Can't parse " + target + ": " + err.Error())
+    }
+}
+
+// scanLine splits a line into tokens. Problems are added to diagnostics, no
+// tokens are returned for lines that contain any.
+func scanLine(name string, number int, line string, diagnostics *Diagnostics) []Token {
+    var tokens []Token
 
-        scanner := bufio.NewScanner(inFile)
-        scanner.Split(bufio.ScanLines)
+    column := 1
+    for i := 0; i < len(line); {
+        c, size := utf8.DecodeRuneInString(line[i:])
+        token := Token{File: name, Line: number, Column: column, Source: line}
 
-        log.Println("Tokenizing...")
+        end := i + size
+        switch {
+        case unicode.IsSpace(c):
+            i = end
+            column++
+            continue
+        case c == '#':
+            token.Kind = TokenComment
+            end = len(line)
+        case c == '\\':
+            // Continues the statement on the next line
+            token.Kind = TokenOperator
+        case c == '"' || c == '\'':
+            value, stop, err := scanString(line, i)
+            if err != nil {
+                token.Text = line[i:stop]
+                diagnostics.add(token, err.Error())
+                return nil
+            }
 
-        currentTokenLine = 0
+            token.Kind = TokenString
+            token.Value = value
+            end = stop
+        case startsNumber(line, i, tokens, column):
+            token.Kind = TokenNumber
+            end = scanNumber(line, i)
+        case unicode.IsLetter(c) || c == '_':
+            token.Kind = TokenIdentifier
+            for end < len(line) {
+                r, n := utf8.DecodeRuneInString(line[end:])
+                if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+                    break
+                }
+                end += n
+            }
+        default:
+            operator := ""
+            for _, symbol := range operatorTokens {
+                if strings.HasPrefix(line[i:], symbol) {
+                    operator = symbol
+                    break
+                }
+            }
 
-        for scanner.Scan() {
-            currentTokenLine++
-            tokenize(scanner.Text(), slice)
+            if operator == "" {
+                token.Text = string(c)
+                diagnostics.add(token, fmt.Sprintf("Unexpected character '%c'", c))
+                return nil
+            }
+
+            token.Kind = TokenOperator
+            end = i + len(operator)
         }
 
-        currentPath = oldPath
+        token.Text = line[i:end]
+        tokens = append(tokens, token)
 
-        return
+        column += utf8.RuneCountInString(token.Text)
+        i = end
+    }
+
+    return tokens
+}
+
+// continuesStatement reports whether the last statement of source continues
+// on a line that hasn't been written yet
+func continuesStatement(source string) bool {
+    t := &tokenizer{logger: discardLogger}
+    for i, line := range strings.Split(source, "\n") {
+        t.tokenize("", i + 1, line)
     }
 
-    *slice = append(*slice, stringSliceToTokenSlice(words))
+    return len(t.pending) > 0
 }
 
-func stringSliceToTokenSlice(vs []string) []Token {
-    var vsm []Token
-    for _, v := range vs {
-        if strings.TrimSpace(v) != "" {
-            vsm = append(vsm, Token{Text: v, File: currentPath, Line: currentTokenLine})
+// adjacent reports whether token b directly follows a, without whitespace in between
+func adjacent(a Token, b Token) bool {
+    return a.File == b.File && a.Line == b.Line && a.Column + utf8.RuneCountInString(a.Text) == b.Column
+}
+
+// startsNumber reports whether a number literal starts at line[i]. A leading
+// . or - is part of the number, unless it directly follows a value like in
+// p.x or n-1.
+func startsNumber(line string, i int, tokens []Token, column int) bool {
+    start := i
+    if line[i] == '-' {
+        start++
+    }
+    if start < len(line) && line[start] == '.' {
+        start++
+    }
+    if start >= len(line) || !isDigit(line[start]) {
+        return false
+    }
+
+    if start == i {
+        return true
+    }
+
+    if len(tokens) == 0 {
+        return true
+    }
+
+    last := tokens[len(tokens) - 1]
+    if last.Column + utf8.RuneCountInString(last.Text) != column {
+        return true
+    }
+
+    return !(last.Kind == TokenIdentifier || last.Kind == TokenNumber || last.Kind == TokenString || last.Text == ")" || last.Text == "]")
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+// scanNumber returns the end of the number literal starting at line[i]
+func scanNumber(line string, i int) int {
+    end := i
+    if line[end] == '-' {
+        end++
+    }
+    for end < len(line) && isDigit(line[end]) {
+        end++
+    }
+    if end + 1 < len(line) && line[end] == '.' && isDigit(line[end + 1]) {
+        end++
+        for end < len(line) && isDigit(line[end]) {
+            end++
         }
     }
-    return vsm
-}
\ No newline at end of file
+
+    return end
+}
+
+// scanString reads the string literal starting with the quote at
+// source[start]. It returns its value with the escape sequences replaced and
+// the index after the closing quote, or after the problem on errors.
+func scanString(source string, start int) (string, int, error) {
+    quote := source[start]
+
+    var value strings.Builder
+    for i := start + 1; i < len(source); i++ {
+        c := source[i]
+
+        if c == quote {
+            return value.String(), i + 1, nil
+        }
+
+        if c != '\\' {
+            value.WriteByte(c)
+            continue
+        }
+
+        if i + 1 >= len(source) {
+            break
+        }
+
+        i++
+        switch source[i] {
+        case 'n':
+            value.WriteByte('\n')
+        case 't':
+            value.WriteByte('\t')
+        case '"', '\'', '\\':
+            value.WriteByte(source[i])
+        default:
+            r, size := utf8.DecodeRuneInString(source[i:])
+            return "", i + size, fmt.Errorf("Unknown escape sequence \\%c, use \\n, \\t, \\\" or \\\\", r)
+        }
+    }
+
+    return "", len(source), errors.New("Unterminated string literal")
+}
+
+// quoteString writes s as a string literal, the opposite of scanString
+func quoteString(s string) string {
+    var quoted strings.Builder
+    quoted.WriteByte('"')
+    for _, c := range s {
+        switch c {
+        case '\n':
+            quoted.WriteString("\\n")
+        case '\t':
+            quoted.WriteString("\\t")
+        case '"', '\\':
+            quoted.WriteByte('\\')
+            quoted.WriteRune(c)
+        default:
+            quoted.WriteRune(c)
+        }
+    }
+    quoted.WriteByte('"')
+
+    return quoted.String()
+}
@@ -0,0 +1,236 @@
+package interpreter
+
+import (
+    "math"
+)
+
+// wholeType is the static type of number literals without a fractional part,
+// they can be used as numbers as well as ints.
+const wholeType = "whole"
+
+// typeChecker statically checks a parsed program. Types are taken from the
+// zero values the parser stores in the static scopes and from the resolved
+// expressions, an empty type means it is only known at runtime.
+type typeChecker struct {
+    diagnostics Diagnostics
+}
+
+// CheckTypes walks every node of a parsed program and reports all type errors
+// at once, instead of failing on the first one at runtime.
+func CheckTypes(nodes []INode) error {
+    checker := &typeChecker{}
+
+    for _, node := range nodes {
+        checker.checkNode(node)
+    }
+
+    if len(checker.diagnostics) > 0 {
+        return checker.diagnostics
+    }
+
+    return nil
+}
+
+func (c *typeChecker) errorf(node INode, message string) {
+    c.diagnostics.add(node.GetPosition(), message)
+}
+
+func (c *typeChecker) checkNode(node INode) {
+    scope := node.GetScope()
+
+    switch n := node.(type) {
+    case *SetNode:
+        c.checkSet(n)
+    case *CallNode:
+        c.checkCall(n)
+    case *ReturnNode:
+        if n.expression == nil {
+            return
+        }
+
+        have := expressionType(n.expression)
+        if n.Function.Result.Type == "string" && isNumericType(have) {
+            return
+        }
+        c.expectType(n, have, n.Function.Result.Type, "return value of " + n.Function.Name)
+    case *ConditionNode:
+        c.expectCondition(n, expressionType(n.expression))
+    case *ElseNode:
+        if n.expression != nil {
+            c.expectCondition(n, expressionType(n.expression))
+        }
+    case *LoopNode:
+        c.expectCondition(n, expressionType(n.expression))
+    case *ForNode:
+        for _, bound := range []*Expression{n.start, n.limit, n.step} {
+            if bound != nil {
+                c.expectType(n, expressionType(bound), "number", "loop bound")
+            }
+        }
+    case *ForEachNode:
+        have := expressionType(n.expression)
+        if have != "" && have != "list" && have != "map" {
+            c.errorf(n, "Can't iterate over " + describeType(have))
+        }
+    case *AppendNode:
+        c.expectType(n, expressionType(n.list), "list", "append target")
+    case *DeleteNode:
+        c.expectType(n, expressionType(n.target), "map", "delete target")
+    case *OutputNode:
+        for _, p := range n.Parameter {
+            c.parameterType(n, scope, p)
+        }
+    case *InputNode:
+        for _, p := range n.Parameter {
+            switch t := c.parameterType(n, scope, p); t {
+            case "", "string", "number", "int", "bool":
+            default:
+                c.errorf(n, "Can't read input into " + describeType(t) + " variable " + p.GetRaw())
+            }
+        }
+    case *ThrowNode:
+        for _, p := range n.Parameter {
+            c.parameterType(n, scope, p)
+        }
+    }
+}
+
+func (c *typeChecker) checkSet(node *SetNode) {
+    scope := node.GetScope()
+
+    want, known := scope.staticType(node.Keyword)
+    if !known {
+        c.errorf(node, "Unknown variable " + node.Keyword)
+        return
+    }
+
+    value := expressionType(node.expression)
+
+    // Follow the fields of the target, values behind indices are untyped
+    current := scope.GetVar(node.Keyword)
+    for _, element := range node.path {
+        if element.index != nil {
+            want = ""
+            current = nil
+            continue
+        }
+
+        s, ok := current.(*Struct)
+        if !ok {
+            want = ""
+            continue
+        }
+
+        current = s.Fields[element.field]
+        want = typeOf(current)
+    }
+
+    if want == "string" && len(node.path) == 0 {
+        // Strings are set by concatenating the parameters, nothing is evaluated
+        for _, p := range node.Parameter[1:] {
+            if _, ok := p.(*OperatorParameter); ok {
+                c.errorf(node, "Operators are not evaluated when setting string " + node.Keyword + ", list the parts to concatenate instead")
+                return
+            }
+        }
+        return
+    }
+
+    c.expectType(node, value, want, node.Target)
+}
+
+func (c *typeChecker) checkCall(node *CallNode) {
+    scope := node.GetScope()
+    fn := scope.GetFunctionNode(node.Parameter[0].GetRaw()).(*FunctionDeclarationNode)
+
+    for _, passer := range fn.Parameters {
+        have := c.parameterType(node, scope, node.Passers[passer.Name])
+        c.expectType(node, have, passer.Type, "parameter " + passer.Name + " of " + fn.Name)
+    }
+
+    if node.Target != "" {
+        want, _ := scope.staticType(node.Target)
+        if want != "" && fn.Result.Type != want && !(want == "number" && fn.Result.Type == "int") {
+            c.errorf(node, "Can't store " + describeType(fn.Result.Type) + " result of " + fn.Name + " in " + describeType(want) + " variable " + node.Target)
+        }
+    }
+}
+
+func (c *typeChecker) expectType(node INode, have, want, what string) {
+    if have == "" || want == "" || have == want {
+        return
+    }
+
+    if want == "number" && (have == "int" || have == wholeType) {
+        return
+    }
+
+    if want == "int" && have == wholeType {
+        return
+    }
+
+    c.errorf(node, "Expected " + describeType(want) + " for " + what + ", got " + describeType(have))
+}
+
+func (c *typeChecker) expectCondition(node INode, have string) {
+    if have != "" && have != "bool" && !isNumericType(have) {
+        c.errorf(node, "Condition has to be a bool or a number, got " + describeType(have))
+    }
+}
+
+func (c *typeChecker) parameterType(node INode, scope *Scope, p IParameter) string {
+    switch v := p.(type) {
+    case *NumberParameter:
+        return literalType(v.GetValue(scope))
+    case *LiteralParameter:
+        return "string"
+    case *BoolParameter:
+        return "bool"
+    case *ExpressionParameter:
+        return expressionType(v.expression)
+    case *VariableParameter:
+        t, known := scope.staticType(v.Text)
+        if !known {
+            c.errorf(node, "Unknown variable " + v.Text)
+        }
+        return t
+    }
+
+    return ""
+}
+
+// expressionType returns the type an expression evaluates to, its variables
+// are already checked when the expression is resolved
+func expressionType(expression *Expression) string {
+    if expression == nil {
+        return ""
+    }
+
+    return expression.Type
+}
+
+func literalType(value interface{}) string {
+    switch v := value.(type) {
+    case int64:
+        return "int"
+    case float64:
+        if v == math.Trunc(v) {
+            return wholeType
+        }
+        return "number"
+    }
+
+    return ""
+}
+
+func isNumericType(t string) bool {
+    return t == "number" || t == "int" || t == wholeType
+}
+
+func describeType(t string) string {
+    if t == wholeType {
+        return "number"
+    }
+
+    return t
+}
@@ -1,8 +1,200 @@
 package interpreter
 
 import (
+    "errors"
+    "fmt"
+    "math"
+    "strconv"
+
+    humanize "github.com/dustin/go-humanize"
 )
 
 type XiiType interface {
     
-}
\ No newline at end of file
+}
+
+// isTypeName reports whether t can be used as a variable or parameter type
+func isTypeName(t string) bool {
+    return t == "number" || t == "int" || t == "string" || t == "bool" || t == "list" || t == "map"
+}
+
+// zeroValue returns the value a freshly declared variable of type t holds
+func zeroValue(t string) interface{} {
+    switch t {
+    case "number":
+        return float64(0)
+    case "int":
+        return int64(0)
+    case "string":
+        return ""
+    case "bool":
+        return false
+    case "list":
+        return NewList()
+    case "map":
+        return NewMap()
+    }
+
+    return nil
+}
+
+// typeOf returns the XiiLang type name of a runtime value
+func typeOf(value interface{}) string {
+    switch v := value.(type) {
+    case float64:
+        return "number"
+    case int64:
+        return "int"
+    case string:
+        return "string"
+    case bool:
+        return "bool"
+    case *List:
+        return "list"
+    case *Map:
+        return "map"
+    case *Struct:
+        return v.Type.Name
+    }
+
+    return "unknown"
+}
+
+// freshValue returns value, or a new zero value for reference types, so that
+// instantiated scopes don't share lists, maps or structs with each other
+func freshValue(value interface{}) interface{} {
+    switch v := value.(type) {
+    case *List:
+        return NewList()
+    case *Map:
+        return NewMap()
+    case *Struct:
+        return v.Type.New()
+    }
+
+    return value
+}
+
+// formatValue converts a value to the text shown by out
+func formatValue(value interface{}) string {
+    return formatNested(value, nil)
+}
+
+// formatElement formats values contained in collections, strings are quoted
+func formatElement(value interface{}) string {
+    return formatNestedElement(value, nil)
+}
+
+// formatNested formats a value contained in the containers outer, which are
+// being formatted. A container that contains itself is shown as [...], {...}
+// or Name{...} where it repeats.
+func formatNested(value interface{}, outer []interface{}) string {
+    switch v := value.(type) {
+    case string:
+        return v
+    case float64:
+        return humanize.Ftoa(v)
+    case int64:
+        return strconv.FormatInt(v, 10)
+    case bool:
+        if v {
+            return "true"
+        }
+        return "false"
+    case *List:
+        if containsValue(outer, v) {
+            return "[...]"
+        }
+        return v.format(append(outer, v))
+    case *Map:
+        if containsValue(outer, v) {
+            return "{...}"
+        }
+        return v.format(append(outer, v))
+    case *Struct:
+        if containsValue(outer, v) {
+            return v.Type.Name + "{...}"
+        }
+        return v.format(append(outer, v))
+    }
+
+    return ""
+}
+
+func formatNestedElement(value interface{}, outer []interface{}) string {
+    if s, ok := value.(string); ok {
+        return quoteString(s)
+    }
+
+    return formatNested(value, outer)
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+
+    return false
+}
+// convertValue prepares value to be stored in a variable of type t. Whole
+// numbers are converted to ints and ints to numbers, everything else is
+// returned as is and has to be type checked by the caller.
+func convertValue(value interface{}, t string) (interface{}, error) {
+    switch v := value.(type) {
+    case float64:
+        if t == "int" {
+            if v != math.Trunc(v) {
+                return nil, fmt.Errorf("Can't store %s in an int, use int() to truncate it", humanize.Ftoa(v))
+            }
+            return numberToInt(v)
+        }
+    case int64:
+        if t == "number" {
+            return float64(v), nil
+        }
+    }
+
+    return value, nil
+}
+
+func numberToInt(v float64) (int64, error) {
+    if math.IsNaN(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+        return 0, fmt.Errorf("%s is out of the range of an int", humanize.Ftoa(v))
+    }
+
+    return int64(v), nil
+}
+
+// builtinInt converts a number to an int, dropping its fractional part
+func builtinInt(arguments ...interface{}) (interface{}, error) {
+    if len(arguments) != 1 {
+        return nil, errors.New("int() takes exactly one parameter")
+    }
+
+    switch v := arguments[0].(type) {
+    case int64:
+        return v, nil
+    case float64:
+        return numberToInt(math.Trunc(v))
+    }
+
+    return nil, fmt.Errorf("int() can't be used on %s", typeOf(arguments[0]))
+}
+
+// builtinNumber converts an int to a number
+func builtinNumber(arguments ...interface{}) (interface{}, error) {
+    if len(arguments) != 1 {
+        return nil, errors.New("number() takes exactly one parameter")
+    }
+
+    switch v := arguments[0].(type) {
+    case int64:
+        return float64(v), nil
+    case float64:
+        return v, nil
+    }
+
+    return nil, fmt.Errorf("number() can't be used on %s", typeOf(arguments[0]))
+}
@@ -0,0 +1,246 @@
+package interpreter
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "io"
+    "io/ioutil"
+    "log"
+    "os"
+    "strings"
+    "time"
+)
+
+// VM is the embeddable entry point into XiiLang. A host program compiles a
+// script once and runs it against the configured streams:
+//
+//  vm := interpreter.NewVM()
+//  vm.Stdout = &buf
+//  if err := vm.Compile(source); err != nil { ... }
+//  if err := vm.Run(ctx); err != nil { ... }
+type VM struct {
+    Stdin io.Reader
+    Stdout io.Writer
+    Stderr io.Writer
+
+    // Debug, Trace and Stats select the debug interpreter, see InterpretDebug
+    Debug bool
+    Trace bool
+    Stats bool
+
+    // VerboseEval traces every evaluated expression to Stderr
+    VerboseEval bool
+
+    // ExecutionTimes holds the durations of the statements executed by the
+    // last Run by keyword, if Stats is set
+    ExecutionTimes map[string][]time.Duration
+
+    // Bytecode runs the program on the bytecode machine instead of walking
+    // the nodes, see Execute. It is ignored by the debug interpreter.
+    Bytecode bool
+
+    // Optimize runs the Optimize pass after the script has been parsed and type checked
+    Optimize bool
+
+    // ModulePath lists the directories imports are searched in, after the
+    // directory of the importing script. It defaults to DefaultModulePath.
+    ModulePath []string
+
+    // Logger receives progress messages and dumps of the compiled program,
+    // they are discarded by default
+    Logger *log.Logger
+
+    nodes []INode
+    program *Program
+    // globals holds the declared values of the global variables, every Run
+    // starts with fresh copies of them
+    globals []declaredScope
+}
+
+// declaredScope is a global scope together with the values its variables
+// are declared with
+type declaredScope struct {
+    scope *Scope
+    values []interface{}
+}
+
+// discardLogger is used where no logger is given
+var discardLogger = log.New(ioutil.Discard, "", 0)
+
+func NewVM() *VM {
+    return &VM{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr, ModulePath: DefaultModulePath(), Logger: discardLogger}
+}
+
+// Compile parses the given XiiLang source. parse and import statements are
+// resolved relative to the current working directory.
+func (vm *VM) Compile(source string) error {
+    return vm.CompileNamed("script.xii", strings.NewReader(source))
+}
+
+// CompileFile parses the XiiLang script at path.
+func (vm *VM) CompileFile(path string) error {
+    logger := orDiscardLogger(vm.Logger)
+    logger.Println("Loading file: " + path)
+
+    tokens, err := tokenizeFile(path, logger)
+    if err != nil {
+        return err
+    }
+
+    return vm.compileTokens(tokens)
+}
+
+// CompileNamed parses the source read from reader, name is used in traces.
+func (vm *VM) CompileNamed(name string, reader io.Reader) error {
+    tokens, err := tokenize(name, reader, orDiscardLogger(vm.Logger))
+    if err != nil {
+        return err
+    }
+
+    return vm.compileTokens(tokens)
+}
+
+func (vm *VM) compileTokens(tokens [][]Token) error {
+    logger := orDiscardLogger(vm.Logger)
+
+    nodes, err := parseTokens(tokens, NewScope(DummyScope), vm.ModulePath, logger)
+    if err != nil {
+        return err
+    }
+
+    err = CheckTypes(nodes)
+    if err != nil {
+        return err
+    }
+
+    if vm.VerboseEval {
+        traceExpressions(orDiscard(vm.Stderr), nodes)
+    }
+
+    if vm.Optimize {
+        count := len(nodes)
+        nodes, err = Optimize(nodes)
+        if err != nil {
+            return err
+        }
+        logger.Printf("Optimizer removed %d of %d nodes\n", count - len(nodes), count)
+    }
+
+    logger.Printf("AST: %s\n", nodes)
+
+    vm.nodes = nodes
+    vm.program = nil
+    vm.globals = declaredScopes(nodes)
+
+    return nil
+}
+
+// declaredScopes collects the global scopes the nodes run in, with the
+// values of their variables before anything ran
+func declaredScopes(nodes []INode) []declaredScope {
+    var scopes []declaredScope
+    seen := make(map[*Scope]bool)
+
+    for _, node := range nodes {
+        for scope := node.GetScope(); scope != nil && scope != DummyScope && scope.function == nil; scope = scope.baseScope {
+            if seen[scope] {
+                break
+            }
+            seen[scope] = true
+
+            values := append([]interface{}(nil), scope.variables...)
+            scopes = append(scopes, declaredScope{scope: scope, values: values})
+        }
+    }
+
+    return scopes
+}
+
+// Nodes returns the compiled program, or nil if nothing has been compiled yet.
+func (vm *VM) Nodes() []INode {
+    return vm.nodes
+}
+
+// Run executes the compiled program until it finishes, fails or ctx is done.
+func (vm *VM) Run(ctx context.Context) error {
+    if vm.nodes == nil {
+        return errors.New("No program compiled")
+    }
+
+    // The global variables are stored in their scopes, they are reset so
+    // every run starts like the first one
+    for _, declared := range vm.globals {
+        for i, value := range declared.values {
+            declared.scope.variables[i] = freshValue(value)
+        }
+    }
+
+    state := vm.newState()
+
+    var err error
+    if vm.Bytecode && !(vm.Debug || vm.Trace || vm.Stats) {
+        err = vm.executeBytecode(ctx, state)
+    } else {
+        err = Interpret(ctx, vm.nodes, state, vm.Debug, vm.Trace, vm.Stats)
+    }
+
+    vm.ExecutionTimes = state.ExecutionTimes
+
+    flushErr := state.StdOut.Flush()
+    if err == nil {
+        err = flushErr
+    }
+
+    return err
+}
+
+func (vm *VM) executeBytecode(ctx context.Context, state *XiiState) error {
+    // The program is compiled again if the eval trace was switched since
+    if vm.program == nil || vm.program.traceEval != vm.VerboseEval {
+        program, err := CompileProgram(vm.nodes, vm.VerboseEval)
+        if err != nil {
+            return err
+        }
+
+        orDiscardLogger(vm.Logger).Printf("Bytecode:\n%s\n", program)
+
+        vm.program = program
+    }
+
+    return Execute(ctx, vm.program, state)
+}
+
+func (vm *VM) newState() *XiiState {
+    state := &XiiState{}
+    state.Nodes = vm.nodes
+    state.NextNode = vm.nodes[0]
+    state.FunctionStack = NewFrameStack()
+    state.StdOut = bufio.NewWriter(orDiscard(vm.Stdout))
+    state.StdIn = bufio.NewReader(vm.Stdin)
+    state.StdErr = orDiscard(vm.Stderr)
+    state.Logger = vm.Logger
+    state.VerboseEval = vm.VerboseEval
+
+    if vm.Stdin == nil {
+        state.StdIn = bufio.NewReader(strings.NewReader(""))
+    }
+
+    return state
+}
+
+func orDiscard(w io.Writer) io.Writer {
+    if w == nil {
+        return ioutil.Discard
+    }
+
+    return w
+}
+
+func orDiscardLogger(logger *log.Logger) *log.Logger {
+    if logger == nil {
+        return discardLogger
+    }
+
+    return logger
+}
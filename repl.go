@@ -0,0 +1,113 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "strings"
+    "github.com/PiMaker/XiiLang/interpreter"
+)
+
+// repl reads statements from stdin and runs them in a single session until
+// stdin is closed. Blocks are collected until their end is typed, results of
+// expressions are printed. If path isn't empty, the script is loaded first.
+// Imports are searched in the directories of modulePath, verboseEval traces
+// every evaluated expression.
+func repl(path string, modulePath []string, verboseEval bool, logger *log.Logger) {
+    stdin := bufio.NewReader(os.Stdin)
+    session := interpreter.NewSession(stdin, os.Stdout, os.Stderr)
+    session.ModulePath = modulePath
+    session.Logger = logger
+    session.VerboseEval = verboseEval
+    ctx := context.Background()
+
+    fmt.Println("Interactive mode, type :vars, :funcs or :load <file>, Ctrl-D to quit")
+
+    if path != "" {
+        printError(session.Load(ctx, path))
+    }
+
+    var buffer []string
+    for {
+        if len(buffer) == 0 {
+            fmt.Print("> ")
+        } else {
+            fmt.Print("... ")
+        }
+
+        line, err := stdin.ReadString('\n')
+        if err != nil && (err != io.EOF || line == "") {
+            fmt.Println()
+            return
+        }
+
+        line = strings.TrimRight(line, "\r\n")
+
+        if len(buffer) == 0 {
+            trimmed := strings.TrimSpace(line)
+            if trimmed == "" {
+                continue
+            }
+
+            if strings.HasPrefix(trimmed, ":") {
+                metaCommand(ctx, session, trimmed)
+                continue
+            }
+        }
+
+        buffer = append(buffer, line)
+        source := strings.Join(buffer, "\n")
+
+        if !session.Complete(source) {
+            continue
+        }
+
+        buffer = nil
+
+        value, ok, err := session.Exec(ctx, "repl", source)
+        if err != nil {
+            printError(err)
+        } else if ok {
+            fmt.Println(interpreter.FormatResult(value))
+        }
+    }
+}
+
+func metaCommand(ctx context.Context, session *interpreter.Session, command string) {
+    words := strings.Fields(command)
+
+    switch words[0] {
+    case ":vars":
+        for _, line := range session.Vars() {
+            fmt.Println(line)
+        }
+    case ":funcs":
+        for _, line := range session.Funcs() {
+            fmt.Println(line)
+        }
+    case ":load":
+        if len(words) != 2 {
+            fmt.Println("Usage: :load <file>")
+            return
+        }
+        printError(session.Load(ctx, words[1]))
+    default:
+        fmt.Println("Unknown command " + words[0] + ", try :vars, :funcs or :load <file>")
+    }
+}
+
+func printError(err error) {
+    if err == nil {
+        return
+    }
+
+    if _, ok := err.(interpreter.Diagnostics); ok {
+        fmt.Println(err.Error())
+        return
+    }
+
+    fmt.Println("Error: " + err.Error())
+}
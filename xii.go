@@ -2,78 +2,92 @@ package main
 
 import (
     "io/ioutil"
-    "os"
-    "bufio"
     "fmt"
     "flag"
     "time"
     "log"
+    "os"
     "sort"
+    "context"
+    "strings"
     "github.com/PiMaker/XiiLang/interpreter"
 )
 
 func main() {
-    fmt.Println("XiiLang(sr) v0.5, (C) Stefan Reiter 2016\n")
+    fmt.Println("XiiLang(sr) v0.5, (C) Stefan Reiter 2016")
+    fmt.Println()
 
     verbose := flag.Bool("v", false, "Be verbose with output")
     debug := flag.Bool("d", false, "Execute a script line by line and wait for enter")
     trace := flag.Bool("t", false, "Trace mode, prints statement information for every executed node")
     verboseEval := flag.Bool("e", false, "Trace eval calls for conditions")
     stats := flag.Bool("s", false, "Print runtime stats after execution")
+    bytecode := flag.Bool("b", false, "Compile the script to bytecode and run it on the bytecode machine")
+    optimize := flag.Bool("o", false, "Optimize the script before running it")
+    dump := flag.Bool("p", false, "Print the optimized program before running it, implies -o")
+    interactive := flag.Bool("i", false, "Start the interactive mode, after running the script if one is given")
+    var includes includeFlags
+    flag.Var(&includes, "I", "Search imported modules in this directory, can be given more than once")
 
     flag.Parse()
 
     verboseVal := *verbose
     path := flag.Arg(0)
 
-    if !verboseVal {
-        log.SetOutput(ioutil.Discard)
+    logger := log.New(ioutil.Discard, "", 0)
+    if verboseVal {
+        logger = log.New(os.Stderr, "", log.LstdFlags)
     }
 
-    interpreter.VerboseEval = *verboseEval
-
     if *verboseEval {
         fmt.Println("Eval trace enabled")
     }
 
-    log.Println("Loading file: " + path)
-
-    startTime := time.Now()
+    // Directories given with -I are searched before XIIPATH and the standard library
+    modulePath := append(includes, interpreter.DefaultModulePath()...)
 
-    tokens, err := interpreter.TokenizeFile(path)
-
-    if err != nil {
-        fmt.Println(err.Error())
+    if *interactive || path == "" {
+        repl(path, modulePath, *verboseEval, logger)
         return
     }
 
-    nodes, err := interpreter.ParseTokens(tokens)
+    startTime := time.Now()
+
+    vm := interpreter.NewVM()
+    vm.Debug = *debug
+    vm.Trace = *trace
+    vm.Stats = *stats
+    vm.VerboseEval = *verboseEval
+    vm.Bytecode = *bytecode
+    vm.Optimize = *optimize || *dump
+    vm.ModulePath = modulePath
+    vm.Logger = logger
+
+    err := vm.CompileFile(path)
     if err != nil {
         fmt.Println(err.Error())
         return
     }
 
-    log.Printf("AST: %s\n", nodes)
+    logger.Printf("Compilation took %s\n", time.Since(startTime))
 
-    log.Printf("Compilation took %s\n", time.Since(startTime))
+    if *dump {
+        fmt.Println(interpreter.FormatNodes(vm.Nodes()))
+        fmt.Println()
+    }
 
     startTime = time.Now()
 
-    state := &interpreter.XiiState{}
-    state.Nodes = nodes
-    state.NextNode = nodes[0]
-    state.FunctionStack = interpreter.NewNodeStack()
-    state.StdOut = bufio.NewWriter(os.Stdout)
-
-    interpreter.Interpret(nodes, state, *debug, *trace, *stats)
-
-    state.StdOut.Flush()
+    err = vm.Run(context.Background())
+    if err != nil {
+        fmt.Println("Error: " + err.Error())
+    }
 
     fmt.Println()
     fmt.Println("XiiLang: Execution ended")
 
     if !*stats {
-        log.Printf("Execution time: %s\n", time.Since(startTime))
+        logger.Printf("Execution time: %s\n", time.Since(startTime))
     }
 
     if *stats {
@@ -82,13 +96,25 @@ func main() {
 
         fmt.Printf("- Execution time total: %s\n", time.Since(startTime))
 
-        slice := convertToSortedSlice(interpreter.ExecutionTimeTable)
+        slice := convertToSortedSlice(vm.ExecutionTimes)
         for _, v := range slice {
             fmt.Printf("- %s: \tTotal: %s / Avg: %s\n", v.Key, v.Value, v.Avg)
         }
     }
 }
 
+// includeFlags collects the directories of all -I flags
+type includeFlags []string
+
+func (i *includeFlags) String() string {
+    return strings.Join(*i, ",")
+}
+
+func (i *includeFlags) Set(dir string) error {
+    *i = append(*i, dir)
+    return nil
+}
+
 func convertToSortedSlice(m map[string][]time.Duration) PairList{
   pl := make(PairList, len(m))
   i := 0